@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 
 	hot "github.com/YuriyNasretdinov/hotreload"
@@ -39,3 +43,286 @@ func resetMethod(t *testing.T, all bool) {
 		t.Fatalf("Must be no errors opening dev null after mock reset!")
 	}
 }
+
+func join(sep string, parts ...string) string {
+	return strings.Join(parts, sep)
+}
+
+func TestMockFunc(t *testing.T) {
+	origJoin := hot.Original(join)
+
+	hot.MockFuncT(t, join, func(sep string, parts ...string) string {
+		return "[" + origJoin(sep, parts...) + "]"
+	})
+
+	if got, want := join(",", "a", "b"), "[a,b]"; got != want {
+		t.Fatalf("Mocked join returned %q, want %q", got, want)
+	}
+}
+
+func TestMockT(t *testing.T) {
+	t.Run("mocked", func(t *testing.T) {
+		hot.MockT(t, osOpen, func(filename string) (*os.File, error) {
+			return nil, errors.New("Cannot open files!")
+		})
+
+		if _, err := osOpen(os.DevNull); err == nil {
+			t.Fatalf("Must be error opening dev null!")
+		}
+	})
+
+	if _, err := osOpen(os.DevNull); err != nil {
+		t.Fatalf("Must be no errors opening dev null after the subtest!")
+	}
+}
+
+func greet(ctx context.Context, name string) string {
+	return "Hello, " + name
+}
+
+func TestMockCtx(t *testing.T) {
+	for _, greeting := range []string{"Hi", "Howdy"} {
+		greeting := greeting
+		t.Run(greeting, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := hot.MockCtx(context.Background(), greet, func(ctx context.Context, name string) string {
+				return greeting + ", " + name
+			})
+
+			for i := 0; i < 100; i++ {
+				if got, want := greet(ctx, "gopher"), greeting+", gopher"; got != want {
+					t.Fatalf("Mocked greet returned %q, want %q", got, want)
+				}
+			}
+
+			if got, want := greet(context.Background(), "gopher"), "Hello, gopher"; got != want {
+				t.Fatalf("greet without the mock returned %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSpy(t *testing.T) {
+	r := hot.SpyT(t, join)
+
+	join(",", "a", "b")
+	join("-")
+
+	r.AssertCalled(t, 2)
+	r.AssertCalledWith(t, 1, ",", []string{"a", "b"})
+	r.AssertCalledWith(t, 1, "-", []string(nil))
+}
+
+func factorial(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return n * factorial(n-1)
+}
+
+func TestOriginalWhileMocked(t *testing.T) {
+	origFactorial := hot.Original(factorial)
+
+	// the mock stops the recursion one level deeper than the original call
+	hot.MockFuncT(t, factorial, func(n int) int { return 100 })
+
+	if got, want := origFactorial(3), 300; got != want {
+		t.Errorf("Original factorial(3) returned %d, want %d", got, want)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				origFactorial(2)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if got := factorial(5); got != 100 {
+					t.Errorf("Mocked factorial(5) returned %d while the original was called", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInstrumented(t *testing.T) {
+	for _, f := range hot.Registered() {
+		if f.Name == "github.com/YuriyNasretdinov/hotreload/cmd/example/osOpen" {
+			if !strings.HasSuffix(f.File, "example_test.go") {
+				t.Errorf("Unexpected position of osOpen: %s:%d", f.File, f.Line)
+			}
+			checkLine(t, f.File, f.Line, "func osOpen(")
+			return
+		}
+	}
+	t.Fatalf("osOpen is not instrumented")
+}
+
+func mapSlice[T, U any](s []T, fn func(T) U) []U {
+	res := make([]U, 0, len(s))
+	for _, v := range s {
+		res = append(res, fn(v))
+	}
+	return res
+}
+
+type stack[T any] struct {
+	items []T
+}
+
+func (s *stack[T]) push(v T) {
+	s.items = append(s.items, v)
+}
+
+func TestGenericsAreSkipped(t *testing.T) {
+	s := &stack[string]{}
+	for _, v := range mapSlice([]int{1, 2}, func(v int) string { return strings.Repeat("a", v) }) {
+		s.push(v)
+	}
+
+	if got, want := strings.Join(s.items, ","), "a,aa"; got != want {
+		t.Errorf("Generic code returned %q, want %q", got, want)
+	}
+
+	for _, f := range hot.Registered() {
+		if strings.HasSuffix(f.Name, "/mapSlice") || strings.HasSuffix(f.Name, "/*stack.push") {
+			t.Errorf("Generic function %s must not be instrumented", f.Name)
+		}
+	}
+}
+
+type upper struct{}
+
+func (upper) convert(_ context.Context, n int, s string) string {
+	return strings.ToUpper(s)
+}
+
+func TestUnnamedParams(t *testing.T) {
+	hot.MockFuncT(t, upper.convert, func(_ upper, _ context.Context, n int, s string) string {
+		return strings.Repeat(s, n)
+	})
+
+	if got, want := (upper{}).convert(context.Background(), 2, "a"), "aa"; got != want {
+		t.Errorf("Mocked convert returned %q, want %q", got, want)
+	}
+
+	ctx := hot.MockCtx(context.Background(), upper.convert, func(_ upper, _ context.Context, n int, s string) string {
+		return "ctx"
+	})
+
+	if got, want := (upper{}).convert(ctx, 2, "a"), "ctx"; got != want {
+		t.Errorf("Context mock of convert returned %q, want %q", got, want)
+	}
+}
+
+type file struct {
+	name string
+}
+
+func (file *file) rename(hot, soft string) *file {
+	file.name = hot + soft
+	return file
+}
+
+func TestClashingParams(t *testing.T) {
+	hot.MockFuncT(t, (*file).rename, func(f *file, a, b string) *file {
+		return &file{name: b + a}
+	})
+
+	if got, want := (&file{}).rename("a", "b").name, "ba"; got != want {
+		t.Errorf("Mocked rename returned %q, want %q", got, want)
+	}
+
+	orig := hot.Original((*file).rename)
+	if got, want := orig(&file{}, "a", "b").name, "ab"; got != want {
+		t.Errorf("Original rename returned %q, want %q", got, want)
+	}
+}
+
+// atomic and atomic1 are declared in the package block, so the instrumented code
+// has to import "sync/atomic" under some other name.
+var atomic, atomic1 = "atomic", "atomic1"
+
+func init() {
+	// the registration of the functions must not be affected by the locals of init
+	hot, atomic := 1, 2
+	_, _ = hot, atomic
+}
+
+func packageName(atomic2 string) string {
+	return atomic + atomic2
+}
+
+func TestImportNameCollisions(t *testing.T) {
+	hot.MockFuncT(t, packageName, func(s string) string {
+		return "mocked " + s
+	})
+
+	if got, want := packageName("2"), "mocked 2"; got != want {
+		t.Errorf("Mocked packageName returned %q, want %q", got, want)
+	}
+}
+
+func whereAmI() (string, int) {
+	_, file, line, _ := runtime.Caller(0)
+	return file, line
+}
+
+func panicky(m map[string]int) {
+	m["boom"]++
+}
+
+// checkLine checks that the position refers to the line of the original (not instrumented) file.
+func checkLine(t *testing.T, file string, line int, want string) {
+	t.Helper()
+
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Could not read %s: %v", file, err)
+	}
+	if !strings.HasPrefix(string(contents), "package ") {
+		t.Errorf("%s is not the original file", file)
+	}
+
+	lines := strings.Split(string(contents), "\n")
+	if line < 1 || line > len(lines) || !strings.Contains(lines[line-1], want) {
+		t.Errorf("%s:%d does not contain %q", file, line, want)
+	}
+}
+
+func TestLineNumbers(t *testing.T) {
+	file, line := whereAmI()
+	checkLine(t, file, line, "runtime.Caller(0)")
+
+	file, line = hot.Original(whereAmI)()
+	checkLine(t, file, line, "runtime.Caller(0)")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("panicky did not panic")
+		}
+
+		pc := make([]uintptr, 20)
+		frames := runtime.CallersFrames(pc[:runtime.Callers(0, pc)])
+		for {
+			fr, more := frames.Next()
+			if strings.HasSuffix(fr.Function, ".panicky") {
+				checkLine(t, fr.File, fr.Line, `m["boom"]++`)
+				return
+			}
+			if !more {
+				break
+			}
+		}
+		t.Errorf("panicky is not in the stack trace")
+	}()
+	panicky(nil)
+}
@@ -10,10 +10,10 @@ import (
 // Mock replaces fp.Close with a new implementation.
 func Mock() {
 	name := "github.com/YuriyNasretdinov/hotreload/cmd/example/fp/Close"
+	origClose := hot.OriginalByName[func(f *os.File) error](name)
 	hot.MockByName(name, func(f *os.File) error {
 		fmt.Printf("File is going to be closed: %s\n", f.Name())
-		res, _ := hot.CallOriginalByName(name, f)[0].(error)
-		return res
+		return origClose(f)
 	})
 }
 
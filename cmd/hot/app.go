@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	hot "github.com/YuriyNasretdinov/hotreload"
+)
+
+const (
+	// stopTimeout is how long the application is given to exit after SIGTERM before it is killed.
+	stopTimeout = 5 * time.Second
+
+	// dialTimeout is how long the application is given to start listening on the control socket.
+	dialTimeout = 30 * time.Second
+)
+
+// proc is a single launch of the user's command.
+type proc struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser // nil when the control socket is used
+	done   chan struct{}  // closed when the process exits
+	loaded int32          // 1 after a plugin was sent to stdin
+
+	restarted bool // the command was launched by restart rather than on start
+}
+
+// app runs the user's command that builds and launches the application
+// and restarts it when a change can't be applied on-the-fly.
+type app struct {
+	args      []string
+	socket    string       // path to the control socket, empty if plugin paths are written to stdin
+	cur       atomic.Value // *proc that is currently running, nil when restarting
+	restarted bool         // restart was called at least once
+
+	// processes that failed after they were sent a plugin to stdin,
+	// which is the only sign that the plugin could not be loaded
+	failed chan *proc
+}
+
+func (a *app) current() *proc {
+	p, _ := a.cur.Load().(*proc)
+	return p
+}
+
+// running reports whether or not the command is running.
+func (a *app) running() bool {
+	p := a.current()
+	if p == nil {
+		return false
+	}
+
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// swap replaces the current process and returns the previous one.
+func (a *app) swap(p *proc) *proc {
+	old, _ := a.cur.Swap(p).(*proc)
+	return old
+}
+
+func newApp(args []string, socket string) *app {
+	a := &app{args: args, socket: socket, failed: make(chan *proc, 1)}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		if p := a.swap(nil); p != nil {
+			p.stop()
+		}
+		if a.socket != "" {
+			os.Remove(a.socket)
+		}
+		log.Fatalf("Received %s", sig)
+	}()
+
+	return a
+}
+
+// start launches the command. If the command exits by itself then so does hot,
+// unless it fails after a restart: the failure is likely caused by the change
+// (e.g. the application does not build anymore) and the next change can fix it.
+func (a *app) start() error {
+	cmd := exec.Command(a.args[0], a.args[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// the command is usually something like `sh -c 'go build && ./app'`,
+	// so it gets it's own process group to be able to stop the app too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	var stdin io.WriteCloser
+	if a.socket != "" {
+		cmd.Env = append(cmd.Env, hot.SocketEnv+"="+a.socket)
+		cmd.Stdin = os.Stdin
+		// the socket of the previous launch must not be mistaken for the new one
+		os.Remove(a.socket)
+	} else {
+		var err error
+		stdin, err = cmd.StdinPipe()
+		if err != nil {
+			return fmt.Errorf("couldn't open stdin pipe: %v", err)
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	p := &proc{cmd: cmd, stdin: stdin, done: make(chan struct{}), restarted: a.restarted}
+
+	a.swap(p)
+
+	go func() {
+		err := cmd.Wait()
+		close(p.done)
+
+		// the process was stopped on purpose
+		if a.current() != p {
+			return
+		}
+		if atomic.LoadInt32(&p.loaded) == 1 && err != nil {
+			// hot.ReloaderLoop() terminates the application if the plugin can't be loaded
+			a.failed <- p
+			return
+		}
+		if p.restarted && err != nil {
+			log.Printf("The command failed after the restart: %v, waiting for the next change", err)
+			return
+		}
+		log.Fatal(err)
+	}()
+
+	return nil
+}
+
+func (p *proc) stop() {
+	syscall.Kill(-p.cmd.Process.Pid, syscall.SIGTERM)
+
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		log.Printf("The application did not exit in %s, killing it", stopTimeout)
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+// restart stops the application, brings the instrumented sources up to date
+// and launches the command again, so that the application is rebuilt.
+func (a *app) restart() {
+	if p := a.swap(nil); p != nil {
+		log.Printf("Stopping the application")
+		p.stop()
+	}
+
+	log.Printf("Rewriting changed files")
+	os.Stderr.Write([]byte("\n"))
+	if err := ws.sync(); err != nil {
+		log.Fatalf("Could not rewrite sources: %v", err)
+	}
+	os.Stderr.Write([]byte("\n"))
+
+	if *reportPath != "" {
+		ws.writeReport(*reportPath)
+	}
+
+	log.Printf("Starting the application again")
+	a.restarted = true
+	if err := a.start(); err != nil {
+		log.Fatalf("Could not start %v: %v", a.args, err)
+	}
+}
+
+// reload asks the application to load the plugin. An error means that the plugin
+// could not be applied.
+func (a *app) reload(req hot.ReloadRequest) error {
+	p := a.current()
+	if p == nil {
+		return nil
+	}
+
+	if a.socket == "" {
+		// the application is restarted if it fails later, see failed
+		atomic.StoreInt32(&p.loaded, 1)
+		if _, err := fmt.Fprintf(p.stdin, "%s\n", req.Plugin); err != nil {
+			return fmt.Errorf("couldn't send the plugin: %v", err)
+		}
+		return nil
+	}
+
+	conn, err := a.dial(p)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	res, err := roundTrip(conn, req)
+	if err != nil {
+		return err
+	}
+
+	if res.Panic != "" {
+		return fmt.Errorf("plugin panicked: %s", res.Panic)
+	} else if !res.OK {
+		return fmt.Errorf("plugin was not loaded: %s", res.Error)
+	}
+
+	log.Printf("Generation %d patched %d function(s): %s", res.Generation, len(res.Patched), strings.Join(res.Patched, ", "))
+	return nil
+}
+
+// dial connects to the control socket, waiting for the application to start listening.
+func (a *app) dial(p *proc) (net.Conn, error) {
+	deadline := time.Now().Add(dialTimeout)
+
+	for {
+		conn, err := net.Dial("unix", a.socket)
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-p.done:
+			return nil, fmt.Errorf("the application exited")
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("couldn't connect to %s: %v", a.socket, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// roundTrip sends the request over the control socket and reads the response.
+func roundTrip(conn net.Conn, req hot.ReloadRequest) (hot.ReloadResponse, error) {
+	var res hot.ReloadResponse
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return res, fmt.Errorf("couldn't send request: %v", err)
+	}
+
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&res); err != nil {
+		return res, fmt.Errorf("couldn't read response: %v", err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	hot "github.com/YuriyNasretdinov/hotreload"
+)
+
+// isCommand reports whether or not the arguments are one of the commands that
+// control the application launched by another hot process with -socket flag.
+func isCommand(args []string) bool {
+	return len(args) > 0 && (args[0] == hot.CommandHistory || args[0] == hot.CommandRollback)
+}
+
+// runCommand executes `hot history` or `hot rollback <generation>`.
+func runCommand(args []string) {
+	conn, err := dialSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := hot.ReloadRequest{Command: args[0]}
+	if req.Command == hot.CommandRollback {
+		if len(args) != 2 {
+			log.Fatal("Usage: hot rollback <generation>")
+		}
+		if req.Generation, err = strconv.Atoi(args[1]); err != nil {
+			log.Fatalf("Invalid generation %q: %v", args[1], err)
+		}
+	}
+
+	res, err := roundTrip(conn, req)
+	if err != nil {
+		log.Fatal(err)
+	} else if !res.OK {
+		log.Fatal(res.Error)
+	}
+
+	if req.Command == hot.CommandRollback {
+		log.Printf("Rolled back to generation %d", res.Generation)
+		return
+	}
+
+	printHistory(res.Generations)
+}
+
+// dialSession connects to the control socket from HOT_SOCKET or,
+// if it is not set, to the only hot session that is running.
+func dialSession() (net.Conn, error) {
+	if path := os.Getenv(hot.SocketEnv); path != "" {
+		return net.Dial("unix", path)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(os.TempDir(), "hot-*.sock"))
+	if err != nil {
+		return nil, err
+	}
+
+	var conns []net.Conn
+	var live []string
+	for _, path := range paths {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conns = append(conns, conn)
+			live = append(live, path)
+		}
+	}
+
+	switch len(conns) {
+	case 0:
+		return nil, fmt.Errorf("No running hot session with -socket flag found")
+	case 1:
+		return conns[0], nil
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil, fmt.Errorf("Several hot sessions are running, set %s to one of: %s", hot.SocketEnv, strings.Join(live, ", "))
+}
+
+func printHistory(gens []hot.Generation) {
+	current := "*"
+	for _, g := range gens {
+		if g.Current {
+			current = ""
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\tGEN\tPARENT\tTIME\tSOURCE\tHASH\tFUNCTIONS")
+	fmt.Fprintf(w, "%s\t0\t\t\t(original code)\t\t\n", current)
+
+	for _, g := range gens {
+		current := ""
+		if g.Current {
+			current = "*"
+		}
+
+		hash := g.Hash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+
+		funcs := make([]string, 0, len(g.Funcs))
+		for _, f := range g.Funcs {
+			funcs = append(funcs, shortFuncName(f))
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", current, g.ID, g.Parent, g.Time.Format("15:04:05"), g.Source, hash, strings.Join(funcs, ", "))
+	}
+	w.Flush()
+}
+
+// shortFuncName strips the package path from the function name leaving only the package name,
+// e.g. "github.com/user/app/pkg/*Type.Method" becomes "pkg/*Type.Method".
+func shortFuncName(name string) string {
+	idx := strings.LastIndex(name, "/")
+	if idx < 0 {
+		return name
+	}
+	return path.Base(name[:idx]) + name[idx:]
+}
@@ -2,66 +2,117 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
 var (
-	watchDir = flag.String("watch", "", "Which directory to watch for changes to do live reload")
+	watchDir    = flag.String("watch", "", "Which directory to watch for changes to do live reload")
+	overlayMode = flag.Bool("overlay", false, "Build the sources in place using `go build -overlay` instead of copying them into $GOPATH/soft")
+	useSocket   = flag.Bool("socket", false, "Send plugins to the application over a control socket instead of stdin")
+	reportPath  = flag.String("report", "", "Write the JSON report of which functions were instrumented and which were skipped and why to the `file` every time the sources are rewritten")
 
 	gopath     = os.Getenv("GOPATH")
-	softDir    = filepath.Join(gopath, "soft")
-	softGopath = filepath.Join(softDir, "p")
+	softDir    string
+	softGopath string
+
+	ws *workspace
+
+	// environment of hot itself, before GOPATH or GOFLAGS are changed for the command
+	origEnv = os.Environ()
 )
 
 func main() {
+	if isCommand(os.Args[1:]) {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	flag.Parse()
 
 	if *watchDir == "" {
 		log.Fatal("Must specify watch dir")
 	}
 
+	if dir, err := filepath.Abs(*watchDir); err == nil {
+		*watchDir = dir
+	}
+
+	// the current directory is changed before the command is launched
+	if *reportPath != "" {
+		if path, err := filepath.Abs(*reportPath); err == nil {
+			*reportPath = path
+		}
+	}
+
 	if gopath == "" {
-		log.Fatal("GOPATH must be set")
+		dir, err := goEnv(".", "GOPATH")
+		if err != nil {
+			log.Fatalf("Could not determine GOPATH: %v", err)
+		}
+		gopath = strings.SplitN(dir, string(os.PathListSeparator), 2)[0]
 	}
 
-	log.Printf("Starting to rewrite %s", gopath)
-	os.Stderr.Write([]byte("\n"))
+	softDir = filepath.Join(gopath, "soft")
+	softGopath = filepath.Join(softDir, "p")
 
-	syncDir(filepath.Join(gopath, "src"), filepath.Join(softGopath, "src"))
+	// GOFLAGS is split on spaces and there is no way to quote them
+	if *overlayMode && strings.ContainsAny(overlayPath(), " \t\n") {
+		log.Fatalf("The overlay path %q contains spaces and can't be passed via GOFLAGS, set GOPATH to a path without spaces or don't use -overlay", overlayPath())
+	}
 
-	os.Setenv("GOPATH", softGopath)
+	var err error
+	ws, err = detectWorkspace(*watchDir, *overlayMode)
+	if err != nil {
+		log.Fatalf("Could not detect workspace: %v", err)
+	}
 
+	for _, t := range ws.trees {
+		log.Printf("Starting to rewrite %s", t.src)
+	}
 	os.Stderr.Write([]byte("\n"))
 
-	if wd, err := os.Getwd(); err == nil && strings.HasPrefix(wd, gopath+string(os.PathSeparator)) {
-		newDir := softGopath + string(os.PathSeparator) + strings.TrimPrefix(wd, gopath+string(os.PathSeparator))
-		log.Printf("Changing current directory to %s", newDir)
-		os.Chdir(newDir)
+	if err := ws.sync(); err != nil {
+		log.Fatalf("Could not rewrite sources: %v", err)
 	}
 
-	args := flag.Args()
+	os.Stderr.Write([]byte("\n"))
 
-	var cmd *exec.Cmd
-	if len(args) > 1 {
-		cmd = exec.Command(args[0], args[1:]...)
-	} else {
-		cmd = exec.Command(args[0])
+	if *reportPath != "" {
+		ws.writeReport(*reportPath)
 	}
 
-	cmd.Env = os.Environ()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if ws.overlay {
+		log.Printf("Using overlay %s", overlayPath())
+		os.Setenv("GOFLAGS", strings.TrimSpace(os.Getenv("GOFLAGS")+" -overlay="+overlayPath()))
+	} else if ws.modDir == "" {
+		os.Setenv("GOPATH", softGopath)
+	}
 
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Printf("Couldn't open stdin pipe: %v", err)
+	if wd, err := os.Getwd(); err == nil && !ws.overlay {
+		if newDir, err := ws.softPath(wd); err == nil {
+			log.Printf("Changing current directory to %s", newDir)
+			os.Chdir(newDir)
+		}
 	}
 
-	go watchChanges(stdin)
+	if flag.NArg() == 0 {
+		log.Fatal("Must specify the command that builds and launches the application")
+	}
+
+	var socket string
+	if *useSocket {
+		socket = filepath.Join(os.TempDir(), fmt.Sprintf("hot-%d.sock", os.Getpid()))
+		log.Printf("Using control socket %s", socket)
+	}
+
+	a := newApp(flag.Args(), socket)
+	if err := a.start(); err != nil {
+		log.Fatalf("Could not start %v: %v", flag.Args(), err)
+	}
 
-	log.Fatal(cmd.Run())
+	watchChanges(a)
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overlayFile is the format of the file that is passed to `go build -overlay`.
+type overlayFile struct {
+	Replace map[string]string
+}
+
+// overlayPath is the path to the overlay file that is passed to the toolchain via GOFLAGS.
+func overlayPath() string {
+	return filepath.Join(softDir, "o", "overlay.json")
+}
+
+func writeOverlayFile(path string, files map[string]string) error {
+	contents, err := json.MarshalIndent(overlayFile{Replace: files}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, contents, 0666)
+}
+
+// writeOverlay rewrites Go files in all the trees and writes the overlay file that
+// substitutes the instrumented copies for the originals, so that the sources are
+// built in place.
+func (w *workspace) writeOverlay() error {
+	files := make(map[string]string)
+
+	for _, t := range w.outerTrees() {
+		err := filepath.Walk(t.src, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				log.Printf("Could not read %s: %s", path, err.Error())
+				return nil
+			}
+
+			if fi.IsDir() {
+				if ignoreDirs[fi.Name()] {
+					return filepath.SkipDir
+				}
+
+				os.Stderr.WriteString("\033[A\033[2K" + path + "\n")
+				return nil
+			}
+
+			if !fi.Mode().IsRegular() || !strings.HasSuffix(path, ".go") {
+				return nil
+			}
+
+			to, err := w.softPath(path)
+			if err != nil {
+				return err
+			}
+
+			if overlayGoFile(fi, path, to) {
+				files[path] = to
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	w.overlayFiles = files
+	return writeOverlayFile(overlayPath(), files)
+}
+
+// overlayGoFile writes the instrumented copy of the file and returns whether or
+// not it needs to be substituted for the original.
+// The original contents of the substituted files are stored next to the copy with the ".orig"
+// suffix (just like when mirroring the trees), so that the files that did not change since
+// the previous run are not rewritten again and so that the changes can be computed later.
+// Files that are used as is only get the hash of their contents stored with the ".hash"
+// suffix, which is enough to notice that they have changed.
+func overlayGoFile(fi os.FileInfo, from, to string) bool {
+	origPath := to + ".orig"
+	hashPath := to + ".hash"
+
+	if origFi, err := os.Stat(origPath); err == nil && statsEqual(fi, origFi) {
+		recordUnchanged(fi, from, to)
+		_, err := os.Stat(to)
+		return err == nil
+	}
+
+	if hashFi, err := os.Stat(hashPath); err == nil && statsEqual(fi, hashFi) {
+		recordUnchanged(fi, from, to)
+		return false
+	}
+
+	oldContents, err := ioutil.ReadFile(from)
+	if err != nil {
+		log.Printf("Could not read %s: %s", from, err.Error())
+		return false
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256(oldContents))
+	if stored, err := ioutil.ReadFile(hashPath); err == nil && string(stored) == hash {
+		// the file was touched without changing it's contents
+		recordUnchanged(fi, from, to)
+		if err := os.Chtimes(hashPath, fi.ModTime(), fi.ModTime()); err != nil {
+			log.Printf("Could not chtimes %s: %s", hashPath, err.Error())
+		}
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		log.Printf("Could not create target dir %s: %s", filepath.Dir(to), err.Error())
+		return false
+	}
+
+	newContents, res, err := rewriteFile(from)
+	recordResult(fi, from, to, res, err)
+	if err != nil {
+		log.Printf("Could not rewrite file %s: %s", from, err.Error())
+		os.Stderr.Write([]byte("\n"))
+		newContents = oldContents
+	}
+
+	instrumented := !bytes.Equal(oldContents, newContents)
+
+	keepPath, keepContents := hashPath, []byte(hash)
+	if instrumented {
+		if err := ioutil.WriteFile(to, newContents, 0666); err != nil {
+			log.Printf("Could not write %s: %s", to, err.Error())
+			return false
+		}
+		os.Remove(hashPath)
+		keepPath, keepContents = origPath, oldContents
+	} else {
+		os.Remove(to)
+		os.Remove(origPath)
+	}
+
+	if err := ioutil.WriteFile(keepPath, keepContents, 0666); err != nil {
+		log.Printf("Could not write %s: %s", keepPath, err.Error())
+		return instrumented
+	}
+
+	if err := os.Chtimes(keepPath, fi.ModTime(), fi.ModTime()); err != nil {
+		log.Printf("Could not chtimes %s: %s", keepPath, err.Error())
+	}
+
+	return instrumented
+}
+
+// liveOverlay writes the overlay file for building the plugin plugPath from liveFile.
+// The plugin sources only exist in the overlay, so the toolchain must be given
+// the package that is returned rather than the file (relative to buildDir).
+// Every plugin gets it's own package, because plugins built from the same package
+// share the plugin path and only the first of them could be opened.
+func (w *workspace) liveOverlay(liveFile, plugPath string) (buildPkg, overlay string, err error) {
+	pkgDir := filepath.Join(w.buildLiveDir(), strings.TrimSuffix(filepath.Base(plugPath), ".so"))
+
+	files := make(map[string]string, len(w.overlayFiles)+1)
+	for k, v := range w.overlayFiles {
+		files[k] = v
+	}
+	files[filepath.Join(pkgDir, filepath.Base(liveFile))] = liveFile
+
+	overlay = filepath.Join(filepath.Dir(liveFile), "overlay.json")
+
+	rel, err := filepath.Rel(w.buildDir(), pkgDir)
+	if err != nil {
+		return "", "", err
+	}
+	return "." + string(os.PathSeparator) + rel, overlay, writeOverlayFile(overlay, files)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOverlayGoFile(t *testing.T) {
+	setTestDirs(t)
+
+	dir := t.TempDir()
+	oldWs := ws
+	defer func() { ws = oldWs }()
+	ws = &workspace{overlay: true}
+	ws.addTree(dir, "example.com/p")
+
+	const withFuncs = "package p\n\nfunc F() int { return 1 }\n"
+	const withoutFuncs = "package p\n\ntype T struct{ N int }\n"
+
+	from := filepath.Join(dir, "a.go")
+	to, err := ws.softPath(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(contents string) os.FileInfo {
+		t.Helper()
+
+		writeFiles(t, dir, map[string]string{"a.go": contents})
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(from, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Stat(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+
+	// check verifies which of the files next to the copy exist and what they contain
+	check := func(wantTo bool, wantOrig, wantHash string) {
+		t.Helper()
+
+		if _, err := os.Stat(to); (err == nil) != wantTo {
+			t.Errorf("%s exists: %v, want %v", to, err == nil, wantTo)
+		}
+
+		for path, want := range map[string]string{to + ".orig": wantOrig, to + ".hash": wantHash} {
+			got, err := ioutil.ReadFile(path)
+			if want == "" && err == nil {
+				t.Errorf("%s must not exist", path)
+			} else if want != "" && string(got) != want {
+				t.Errorf("%s = %q, %v, want %q", path, got, err, want)
+			}
+		}
+	}
+
+	hash := func(contents string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(contents)))
+	}
+
+	fi := write(withFuncs)
+	if !overlayGoFile(fi, from, to) {
+		t.Fatalf("file with functions must be substituted")
+	}
+	check(true, withFuncs, "")
+
+	// unchanged files are not rewritten again
+	if err := ioutil.WriteFile(to, []byte("stale"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if !overlayGoFile(fi, from, to) {
+		t.Errorf("unchanged file with functions must be substituted")
+	}
+	if got, _ := ioutil.ReadFile(to); string(got) != "stale" {
+		t.Errorf("unchanged file was rewritten: %q", got)
+	}
+
+	fi = write(withoutFuncs)
+	if overlayGoFile(fi, from, to) {
+		t.Errorf("file without changes must be used as is")
+	}
+	check(false, "", hash(withoutFuncs))
+
+	// the file is touched without changing it's contents
+	fi = write(withoutFuncs)
+	if overlayGoFile(fi, from, to) {
+		t.Errorf("touched file without changes must be used as is")
+	}
+	check(false, "", hash(withoutFuncs))
+
+	if hashFi, err := os.Stat(to + ".hash"); err != nil || !statsEqual(fi, hashFi) {
+		t.Errorf("modification time of the hash must be updated: %v", err)
+	}
+
+	fi = write(withFuncs)
+	if !overlayGoFile(fi, from, to) {
+		t.Errorf("file with new functions must be substituted")
+	}
+	check(true, withFuncs, "")
+}
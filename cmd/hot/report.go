@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileReport describes what the rewriter did to a single file.
+type fileReport struct {
+	Instrumented int // the number of functions that can be mocked and reloaded on-the-fly
+	Skipped      []skippedFunc
+}
+
+// skippedFunc is a function that was left as is by the rewriter.
+type skippedFunc struct {
+	Name   string
+	File   string `json:",omitempty"`
+	Reason string
+}
+
+// failedFile is a file that could not be rewritten, so it is used as is.
+type failedFile struct {
+	File  string
+	Error string
+}
+
+// pkgReport describes what the rewriter did to a package.
+type pkgReport struct {
+	Package      string
+	Name         string `json:",omitempty"` // tells the package from it's external tests
+	Instrumented int
+	Skipped      []skippedFunc `json:",omitempty"`
+	Failed       []failedFile  `json:",omitempty"`
+}
+
+// noBodyReason explains why the function does not have a body.
+func noBodyReason(d *ast.FuncDecl) string {
+	if d.Doc != nil {
+		for _, c := range d.Doc.List {
+			if strings.HasPrefix(c.Text, "//go:linkname ") {
+				return "no body (go:linkname)"
+			}
+		}
+	}
+	return "no body (assembly)"
+}
+
+// fileResult is what the rewriter did to a single file. It is cached next to the instrumented copy
+// with the ".report" suffix, so that the report does not require rewriting the files that did not change.
+type fileResult struct {
+	Report fileReport
+	Error  string `json:",omitempty"` // the file could not be rewritten and is used as is
+}
+
+// fileResults are the results for the Go files in the trees by the original path.
+// They are collected by sync when the report is requested.
+var fileResults = make(map[string]fileResult)
+
+// recordResult remembers what the rewriter did to the file from and caches it next to
+// the instrumented copy to.
+func recordResult(fi os.FileInfo, from, to string, res fileReport, err error) {
+	if *reportPath == "" || !strings.HasSuffix(from, ".go") {
+		return
+	}
+
+	r := fileResult{Report: res}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	fileResults[from] = r
+
+	contents, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Could not encode the report for %s: %s", from, err.Error())
+		return
+	}
+
+	cachePath := to + ".report"
+	if err := ioutil.WriteFile(cachePath, contents, 0666); err != nil {
+		log.Printf("Could not write %s: %s", cachePath, err.Error())
+		return
+	}
+
+	if err := os.Chtimes(cachePath, fi.ModTime(), fi.ModTime()); err != nil {
+		log.Printf("Could not chtimes %s: %s", cachePath, err.Error())
+	}
+}
+
+// recordUnchanged remembers the cached result for the file from that was not rewritten
+// because it did not change since the previous sync.
+func recordUnchanged(fi os.FileInfo, from, to string) {
+	if *reportPath == "" || !strings.HasSuffix(from, ".go") {
+		return
+	}
+
+	cachePath := to + ".report"
+	if cacheFi, err := os.Stat(cachePath); err == nil && statsEqual(fi, cacheFi) {
+		var r fileResult
+		if contents, err := ioutil.ReadFile(cachePath); err == nil && json.Unmarshal(contents, &r) == nil {
+			fileResults[from] = r
+			return
+		}
+	}
+
+	// the file was rewritten when the report was not requested
+	_, res, err := instrumentFile(from)
+	recordResult(fi, from, to, res, err)
+}
+
+// filePackage returns the name of the package of the Go file. The files that are excluded
+// by build constraints (e.g. the declarations of assembly functions for other platforms)
+// are not built, so ok is false for them.
+func filePackage(path string) (name string, ok bool) {
+	if match, err := build.Default.MatchFile(filepath.Dir(path), filepath.Base(path)); err == nil && !match {
+		return "", false
+	}
+
+	// the name is unknown for the files with syntax errors in the package clause
+	if f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly); err == nil {
+		name = f.Name.Name
+	}
+	return name, true
+}
+
+// buildReport groups the results of rewriting the files collected during the last sync by package.
+func (w *workspace) buildReport() []*pkgReport {
+	files := make([]string, 0, len(fileResults))
+	for path := range fileResults {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+
+	type pkgKey struct{ path, name string }
+	pkgs := make(map[pkgKey]*pkgReport)
+	for _, path := range files {
+		pkgPath, err := w.importPath(filepath.Dir(path))
+		if err != nil || isSoftPackage(pkgPath) {
+			continue
+		}
+
+		name, ok := filePackage(path)
+		if !ok {
+			continue
+		}
+
+		key := pkgKey{pkgPath, name}
+		p := pkgs[key]
+		if p == nil {
+			p = &pkgReport{Package: pkgPath, Name: name}
+			pkgs[key] = p
+		}
+
+		r := fileResults[path]
+		if r.Error != "" {
+			p.Failed = append(p.Failed, failedFile{File: path, Error: r.Error})
+			continue
+		}
+
+		p.Instrumented += r.Report.Instrumented
+		for _, s := range r.Report.Skipped {
+			s.File = path
+			p.Skipped = append(p.Skipped, s)
+		}
+	}
+
+	res := make([]*pkgReport, 0, len(pkgs))
+	for _, p := range pkgs {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Package != res[j].Package {
+			return res[i].Package < res[j].Package
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// writeReport writes the instrumentation report to the file in JSON format
+// and logs the totals.
+func (w *workspace) writeReport(path string) {
+	pkgs := w.buildReport()
+
+	var instrumented, skipped, failed int
+	for _, p := range pkgs {
+		instrumented += p.Instrumented
+		skipped += len(p.Skipped)
+		failed += len(p.Failed)
+	}
+
+	contents, err := json.MarshalIndent(pkgs, "", "\t")
+	if err != nil {
+		log.Printf("Could not encode the instrumentation report: %v", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(path, append(contents, '\n'), 0666); err != nil {
+		log.Printf("Could not write the instrumentation report: %v", err)
+		return
+	}
+
+	log.Printf("Instrumented %d functions in %d packages, skipped %d functions, could not rewrite %d files, see %s for details",
+		instrumented, len(pkgs), skipped, failed, path)
+}
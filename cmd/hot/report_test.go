@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildReport(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.go":        "package p\n",
+		"a_test.go":   "package p\n",
+		"x_test.go":   "package p_test\n",
+		"stub.go":     "//go:build never\n\npackage p\n",
+		"broken.go":   "package p\n\nfunc\n",
+		"sub/sub.go":  "package sub\n",
+		"sub/sub2.go": "package sub\n",
+	})
+
+	oldWs, oldResults := ws, fileResults
+	t.Cleanup(func() { ws, fileResults = oldWs, oldResults })
+	ws = &workspace{}
+	ws.addTree(dir, "example.com/p")
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+	skipped := func(name string) fileResult {
+		return fileResult{Report: fileReport{Skipped: []skippedFunc{{Name: name, Reason: "generic"}}}}
+	}
+	fileResults = map[string]fileResult{
+		path("a.go"):        {Report: fileReport{Instrumented: 2}},
+		path("a_test.go"):   {Report: fileReport{Instrumented: 1}},
+		path("x_test.go"):   skipped("g"),
+		path("stub.go"):     skipped("asm"),
+		path("broken.go"):   {Error: "syntax error"},
+		path("sub/sub.go"):  {Report: fileReport{Instrumented: 1}},
+		path("sub/sub2.go"): {Report: fileReport{Instrumented: 3}},
+	}
+
+	want := []*pkgReport{
+		{Package: "example.com/p", Name: "p", Instrumented: 3, Failed: []failedFile{{File: path("broken.go"), Error: "syntax error"}}},
+		{Package: "example.com/p", Name: "p_test", Skipped: []skippedFunc{{Name: "g", File: path("x_test.go"), Reason: "generic"}}},
+		{Package: "example.com/p/sub", Name: "sub", Instrumented: 4},
+	}
+
+	got := ws.buildReport()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:")
+		for _, p := range got {
+			t.Errorf("%+v", *p)
+		}
+		t.Errorf("want:")
+		for _, p := range want {
+			t.Errorf("%+v", *p)
+		}
+	}
+}
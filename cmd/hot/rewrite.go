@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"crypto/md5"
-	"errors"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/printer"
 	"go/token"
 	"io/ioutil"
-	"os"
+	"log"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -20,53 +20,79 @@ var printerCfg = &printer.Config{
 	Mode:     printer.SourcePos,
 }
 
-// TODO: make sure that "soft" is not used and handle case when "atomic" is imported under a different name
-func addSoftImport(fset *token.FileSet, f *ast.File) {
-	importSpecs := []ast.Spec{
-		&ast.ImportSpec{
-			Name: &ast.Ident{
-				Name: "hot",
-			},
-			Path: &ast.BasicLit{
-				Kind:  token.STRING,
-				Value: `"github.com/YuriyNasretdinov/hotreload"`,
-			},
-		},
-		&ast.ImportSpec{
-			Path: &ast.BasicLit{
-				Kind:  token.STRING,
-				Value: `"sync/atomic"`,
-			},
-		},
-	}
-
-	alreadyImported := make(map[string]bool)
+// importNames are the names under which the packages the rewritten code refers to are imported in the file.
+type importNames struct {
+	hot    string
+	atomic string
+	add    []ast.Spec // the imports that the file lacks
+}
 
-	for _, d := range f.Decls {
-		if d, ok := d.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
-			for _, sp := range d.Specs {
-				if sp, ok := sp.(*ast.ImportSpec); ok {
-					alreadyImported[sp.Path.Value] = true
-				}
-			}
+// chooseImportNames returns the names under which "hot" and "sync/atomic" packages are imported in the file.
+// The packages that are not imported yet (or are imported as "_" or ".") get a reserved alias, so that
+// it can't collide with the names declared in the other files of the package: the files are only
+// instrumented again when they change themselves. The alias still must not collide with the names
+// declared in the file and the names the file refers to, including other imports.
+// The names of the arguments are taken care of by renameClashingParams.
+func chooseImportNames(f *ast.File) *importNames {
+	taken := make(map[string]bool)
+	for name := range f.Scope.Objects {
+		taken[name] = true
+	}
+	for _, id := range f.Unresolved {
+		taken[id.Name] = true
+	}
+	for _, imp := range f.Imports {
+		if imp.Name != nil {
+			taken[imp.Name.Name] = true
+		} else if p, err := strconv.Unquote(imp.Path.Value); err == nil {
+			taken[path.Base(p)] = true
 		}
 	}
 
-	var specs []ast.Spec
+	imp := &importNames{}
+	imp.hot = imp.importName(f, taken, hotPkgPath, "hot", "softMocksHot")
+	imp.atomic = imp.importName(f, taken, "sync/atomic", "atomic", "softMocksAtomic")
+	return imp
+}
 
-	for _, sp := range importSpecs {
-		if alreadyImported[sp.(*ast.ImportSpec).Path.Value] {
+// importName returns the name of the package pkgPath if the file imports it, otherwise the package
+// is added to the imports under the alias.
+func (imp *importNames) importName(f *ast.File, taken map[string]bool, pkgPath, pkgName, alias string) string {
+	for _, spec := range f.Imports {
+		if spec.Path.Value != strconv.Quote(pkgPath) {
 			continue
 		}
-		specs = append(specs, sp)
+		if spec.Name == nil {
+			return pkgName
+		}
+		if spec.Name.Name != "_" && spec.Name.Name != "." {
+			return spec.Name.Name
+		}
 	}
 
-	if len(specs) == 0 {
+	name := alias
+	for i := 1; taken[name]; i++ {
+		name = fmt.Sprintf("%s%d", alias, i)
+	}
+	taken[name] = true
+
+	imp.add = append(imp.add, &ast.ImportSpec{
+		Name: ast.NewIdent(name),
+		Path: &ast.BasicLit{
+			Kind:  token.STRING,
+			Value: strconv.Quote(pkgPath),
+		},
+	})
+	return name
+}
+
+func addSoftImport(f *ast.File, imp *importNames) {
+	if len(imp.add) == 0 {
 		return
 	}
 
-	decls := make([]ast.Decl, 0, len(f.Decls)+len(specs))
-	for _, sp := range specs {
+	decls := make([]ast.Decl, 0, len(f.Decls)+len(imp.add))
+	for _, sp := range imp.add {
 		decls = append(decls, &ast.GenDecl{
 			Tok:   token.IMPORT,
 			Specs: []ast.Spec{sp},
@@ -92,36 +118,70 @@ func funcDeclFlagName(fset *token.FileSet, d *ast.FuncDecl) string {
 	return fmt.Sprintf("softMocksFlag_%x", h.Sum(nil))
 }
 
-// checks if we have situation like "func (file *file) close() error" in "os" package
-// TODO: we can actually rename arguments when this happens so there is no ambiguity
-func typesClashWithArgNames(decls []*ast.Field) bool {
-	// there also are some predefined names, such as "soft" and "hot" that can't be
-	// used as variables inside the function without causing problems.
-	namesMap := map[string]bool{
-		"hot":  true,
-		"soft": true,
-	}
-	for _, d := range decls {
-		for _, n := range d.Names {
-			namesMap[n.Name] = true
-		}
+// renameClashingParams renames the receiver, arguments and named results of the function that
+// would shadow the packages pkgs the generated code refers to.
+// All references to the renamed names in the body are renamed too.
+func renameClashingParams(d *ast.FuncDecl, pkgs ...string) {
+	var fields []*ast.Field
+	if d.Recv != nil {
+		fields = append(fields, d.Recv.List...)
+	}
+	fields = append(fields, d.Type.Params.List...)
+	if d.Type.Results != nil {
+		fields = append(fields, d.Type.Results.List...)
 	}
 
-	clash := false
+	reserved := make(map[string]bool)
+	for _, pkg := range pkgs {
+		reserved[pkg] = true
+	}
 
-	for _, d := range decls {
-		ast.Inspect(d.Type, func(n ast.Node) bool {
-			switch n := n.(type) {
-			case *ast.Ident:
-				if namesMap[n.Name] {
-					clash = true
-				}
+	renamed := make(map[*ast.Object]string)
+	for _, fl := range fields {
+		for _, n := range fl.Names {
+			if !reserved[n.Name] {
+				continue
 			}
-			return true
-		})
+			if n.Obj != nil {
+				renamed[n.Obj] = "hotParam_" + n.Name
+			}
+			n.Name = "hotParam_" + n.Name
+		}
+	}
+
+	if len(renamed) == 0 || d.Body == nil {
+		return
+	}
+
+	ast.Inspect(d.Body, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj != nil && renamed[id.Obj] != "" {
+			id.Name = renamed[id.Obj]
+		}
+		return true
+	})
+}
+
+// isGeneric reports whether or not the function has type parameters or is a method of a generic type.
+// Such functions can't be referred to without instantiating them and only the compiler knows
+// which instantiations exist, so they are not instrumented.
+func isGeneric(d *ast.FuncDecl) bool {
+	if d.Type.TypeParams != nil {
+		return true
+	}
+	if d.Recv == nil {
+		return false
 	}
 
-	return clash
+	typ := d.Recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+
+	switch typ.(type) {
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		return true
+	}
+	return false
 }
 
 func funcDeclExpr(f *ast.FuncDecl) ast.Expr {
@@ -135,34 +195,55 @@ func funcDeclExpr(f *ast.FuncDecl) ast.Expr {
 	}
 }
 
-var ErrNoNames = errors.New("No names in receiver")
+// nameParams gives names to the unnamed and blank ("_") receiver and arguments of the function
+// so that they can be passed to the mock. The names do not shadow anything the body can refer to.
+func nameParams(d *ast.FuncDecl) {
+	if d.Recv != nil {
+		recv := d.Recv.List[0]
+		if len(recv.Names) == 0 {
+			recv.Names = []*ast.Ident{ast.NewIdent("hotRecv")}
+		} else if recv.Names[0].Name == "_" {
+			recv.Names[0].Name = "hotRecv"
+		}
+	}
+
+	i := 0
+	for _, t := range d.Type.Params.List {
+		if len(t.Names) == 0 {
+			t.Names = []*ast.Ident{ast.NewIdent(fmt.Sprintf("hotArg%d", i))}
+			i++
+			continue
+		}
+
+		for _, n := range t.Names {
+			if n.Name == "_" {
+				n.Name = fmt.Sprintf("hotArg%d", i)
+			}
+			i++
+		}
+	}
+}
 
-func argNamesFromFuncDecl(f *ast.FuncDecl) ([]ast.Expr, bool, error) {
+// argNamesFromFuncDecl returns the receiver and the arguments of the function (named by nameParams)
+// and whether or not the function is variadic.
+func argNamesFromFuncDecl(f *ast.FuncDecl) ([]ast.Expr, bool) {
 	var res []ast.Expr
 	var haveEllipsis bool
 
 	if f.Recv != nil {
-		names := f.Recv.List[0].Names
-		if len(names) == 0 {
-			return nil, false, ErrNoNames
-		}
-		res = append(res, names[0])
+		res = append(res, ast.NewIdent(f.Recv.List[0].Names[0].Name))
 	}
 
 	for _, t := range f.Type.Params.List {
-		if len(t.Names) == 0 {
-			return nil, false, ErrNoNames
-		}
-
 		for _, n := range t.Names {
 			if _, ok := t.Type.(*ast.Ellipsis); ok {
 				haveEllipsis = true
 			}
-			res = append(res, n)
+			res = append(res, ast.NewIdent(n.Name))
 		}
 	}
 
-	return res, haveEllipsis, nil
+	return res, haveEllipsis
 }
 
 func funcDeclType(f *ast.FuncDecl) ast.Expr {
@@ -176,10 +257,6 @@ func funcDeclType(f *ast.FuncDecl) ast.Expr {
 		in = append(in, t)
 	}
 
-	if typesClashWithArgNames(in) {
-		return nil
-	}
-
 	return &ast.FuncType{
 		Params:  &ast.FieldList{List: in},
 		Results: f.Type.Results,
@@ -188,27 +265,55 @@ func funcDeclType(f *ast.FuncDecl) ast.Expr {
 
 type funcMeta struct {
 	flagName string // the flag name to be used in the interceptor
+	slotName string // the name of the atomic.Value that holds the mock
+	typeName string // the name of the alias of the function type the mock has
+	origName string // the name of the function with the original body and no interceptor
+	ctxName  string // the name of the context.Context argument, if any
 	funcName string // a unique name for the function that can be used to fully identify it
 }
 
 type funcFlags map[*ast.FuncDecl]funcMeta
 
-func addInit(hashes funcFlags, initFunc *ast.FuncDecl, fset *token.FileSet, f *ast.File) {
+// addInit declares the flags, the slots and the types of the functions and registers the functions
+// in a separate init() so that no local variable of the existing one can shadow the imports.
+// The declarations that belong to a function are attributed to the line of the function
+// in stack traces.
+func addInit(hashes funcFlags, imp *importNames, f *ast.File) {
+	types := &ast.GenDecl{Tok: token.TYPE}
 	specs := &ast.ValueSpec{
 		Type: ast.NewIdent("int32"),
 	}
+	slotSpecs := &ast.ValueSpec{
+		Type: &ast.SelectorExpr{
+			X:   ast.NewIdent(imp.atomic),
+			Sel: ast.NewIdent("Value"),
+		},
+	}
+	initFunc := &ast.FuncDecl{
+		Name: ast.NewIdent("init"),
+		Type: &ast.FuncType{},
+		Body: &ast.BlockStmt{},
+	}
 
 	for decl, flagMeta := range hashes {
 		specs.Names = append(specs.Names, ast.NewIdent(flagMeta.flagName))
+		slotSpecs.Names = append(slotSpecs.Names, ast.NewIdent(flagMeta.slotName))
+
+		types.Specs = append(types.Specs, &ast.TypeSpec{
+			Name:   &ast.Ident{Name: flagMeta.typeName, NamePos: decl.Pos()},
+			Assign: decl.Pos(),
+			Type:   funcDeclType(decl),
+		})
 
 		initFunc.Body.List = append(initFunc.Body.List, &ast.ExprStmt{
 			X: &ast.CallExpr{
 				Fun: &ast.SelectorExpr{
-					X:   ast.NewIdent("hot"),
+					X:   &ast.Ident{Name: imp.hot, NamePos: decl.Pos()},
 					Sel: ast.NewIdent("RegisterFunc"),
 				},
 				Args: []ast.Expr{
 					funcDeclExpr(decl),
+					ast.NewIdent(flagMeta.origName),
 					&ast.BasicLit{
 						Value: fmt.Sprintf("%q", flagMeta.funcName),
 					},
@@ -216,49 +321,131 @@ func addInit(hashes funcFlags, initFunc *ast.FuncDecl, fset *token.FileSet, f *a
 						Op: token.AND,
 						X:  ast.NewIdent(flagMeta.flagName),
 					},
+					&ast.UnaryExpr{
+						Op: token.AND,
+						X:  ast.NewIdent(flagMeta.slotName),
+					},
 				},
 			},
 		})
 
 	}
 
-	f.Decls = append(f.Decls, &ast.GenDecl{
+	f.Decls = append(f.Decls, types, &ast.GenDecl{
 		Tok:   token.VAR,
-		Specs: []ast.Spec{specs},
-	})
+		Specs: []ast.Spec{specs, slotSpecs},
+	}, initFunc)
+}
+
+// contextImportName returns the name under which "context" package is imported in the file.
+func contextImportName(f *ast.File) string {
+	for _, imp := range f.Imports {
+		if imp.Path.Value != `"context"` {
+			continue
+		}
+		if imp.Name == nil {
+			return "context"
+		}
+		if imp.Name.Name != "_" && imp.Name.Name != "." {
+			return imp.Name.Name
+		}
+	}
+	return ""
 }
 
-func getInterceptor(decl *ast.FuncDecl, haveReturn bool) *ast.IfStmt {
-	funcType := funcDeclType(decl)
-	if funcType == nil {
-		return nil
+// contextParam returns the name of the first context.Context argument of the function, if any.
+func contextParam(d *ast.FuncDecl, ctxPkg string) string {
+	if ctxPkg == "" {
+		return ""
 	}
 
-	args, haveEllipsis, err := argNamesFromFuncDecl(decl)
-	if err != nil {
-		return nil
+	for _, t := range d.Type.Params.List {
+		sel, ok := t.Type.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Context" {
+			continue
+		}
+		if x, ok := sel.X.(*ast.Ident); !ok || x.Name != ctxPkg {
+			continue
+		}
+
+		for _, n := range t.Names {
+			if n.Name != "_" {
+				return n.Name
+			}
+		}
+	}
+	return ""
+}
+
+func getInterceptor(decl *ast.FuncDecl, meta funcMeta, imp *importNames, haveReturn bool) []ast.Stmt {
+	args, haveEllipsis := argNamesFromFuncDecl(decl)
+
+	// the variable that holds the mock must not shadow the arguments
+	taken := make(map[string]bool)
+	for _, arg := range args {
+		taken[arg.(*ast.Ident).Name] = true
+	}
+	mockName := "soft"
+	for taken[mockName] {
+		mockName += "_"
 	}
 
-	// if soft := hot.GetMockFor(<function pointer>); soft != nil {
-	//   return soft.(func(...) ...)(<args>)
+	// if soft, _ := <slot>.Load().(<type>); soft != nil {
+	//   return soft(<args>)
 	//     -or-
-	//   soft.(func(...) ...)(<args>)
+	//   soft(<args>)
 	//   return
 	// }
+	//
+	// Functions with a context.Context argument first check the same way
+	// for the mock that is bound to the context:
+	//
+	// if soft, _ := hot.ContextMock(<ctx>, &<slot>).(<type>); soft != nil {
+	//
+	// <type> is the alias of the function type declared by addInit, so the interceptor
+	// fits on a single line whatever the signature looks like.
+
+	stmts := []ast.Stmt{
+		callMockStmt(&ast.TypeAssertExpr{
+			X: &ast.CallExpr{
+				Fun: &ast.SelectorExpr{
+					X:   ast.NewIdent(meta.slotName),
+					Sel: ast.NewIdent("Load"),
+				},
+			},
+			Type: ast.NewIdent(meta.typeName),
+		}, mockName, args, haveEllipsis, haveReturn),
+	}
 
-	getMockExpr := &ast.CallExpr{
-		Fun: &ast.SelectorExpr{
-			X:   ast.NewIdent("hot"),
-			Sel: ast.NewIdent("GetMockFor"),
-		},
-		Args: []ast.Expr{funcDeclExpr(decl)},
+	if meta.ctxName != "" {
+		ctxStmt := callMockStmt(&ast.TypeAssertExpr{
+			X: &ast.CallExpr{
+				Fun: &ast.SelectorExpr{
+					X:   ast.NewIdent(imp.hot),
+					Sel: ast.NewIdent("ContextMock"),
+				},
+				Args: []ast.Expr{
+					ast.NewIdent(meta.ctxName),
+					&ast.UnaryExpr{
+						Op: token.AND,
+						X:  ast.NewIdent(meta.slotName),
+					},
+				},
+			},
+			Type: ast.NewIdent(meta.typeName),
+		}, mockName, args, haveEllipsis, haveReturn)
+
+		stmts = append([]ast.Stmt{ctxStmt}, stmts...)
 	}
 
+	return stmts
+}
+
+// callMockStmt returns the statement that stores the mock returned by loadMockExpr
+// in the variable mockName and calls it if it is not nil.
+func callMockStmt(loadMockExpr ast.Expr, mockName string, args []ast.Expr, haveEllipsis, haveReturn bool) ast.Stmt {
 	callExpr := &ast.CallExpr{
-		Fun: &ast.TypeAssertExpr{
-			X:    getMockExpr,
-			Type: funcType,
-		},
+		Fun:  ast.NewIdent(mockName),
 		Args: args,
 	}
 
@@ -277,25 +464,51 @@ func getInterceptor(decl *ast.FuncDecl, haveReturn bool) *ast.IfStmt {
 	return &ast.IfStmt{
 		Init: &ast.AssignStmt{
 			Tok: token.DEFINE,
-			Lhs: []ast.Expr{ast.NewIdent("soft")},
-			Rhs: []ast.Expr{getMockExpr},
+			Lhs: []ast.Expr{ast.NewIdent(mockName), ast.NewIdent("_")},
+			Rhs: []ast.Expr{loadMockExpr},
 		},
 		Cond: &ast.BinaryExpr{
 			Op: token.NEQ,
-			X:  ast.NewIdent("soft"),
+			X:  ast.NewIdent(mockName),
 			Y:  ast.NewIdent("nil"),
 		},
 		Body: &ast.BlockStmt{List: bodyStmts},
 	}
 }
 
-func injectInterceptors(flags funcFlags) {
+// originalDecl returns the copy of the function that can be called to execute the original
+// code without the interceptor. Methods become functions with the receiver as the first argument,
+// just like method expressions.
+func originalDecl(decl *ast.FuncDecl, name string) *ast.FuncDecl {
+	var params []*ast.Field
+	if decl.Recv != nil {
+		params = append(params, decl.Recv.List[0])
+	}
+	params = append(params, decl.Type.Params.List...)
+
+	return &ast.FuncDecl{
+		Name: ast.NewIdent(name),
+		Type: &ast.FuncType{
+			Func:    decl.Type.Func,
+			Params:  &ast.FieldList{List: params},
+			Results: decl.Type.Results,
+		},
+		Body: &ast.BlockStmt{
+			Lbrace: decl.Body.Lbrace,
+			List:   decl.Body.List,
+			Rbrace: decl.Body.Rbrace,
+		},
+	}
+}
+
+// injectInterceptors adds interceptors to the functions and returns the copies of
+// the functions without them.
+func injectInterceptors(flags funcFlags, imp *importNames) map[*ast.FuncDecl]*ast.FuncDecl {
+	originals := make(map[*ast.FuncDecl]*ast.FuncDecl, len(flags))
+
 	for decl, flagMeta := range flags {
-		interceptor := getInterceptor(decl, decl.Type.Results != nil)
-		if interceptor == nil {
-			delete(flags, decl)
-			continue
-		}
+		interceptor := getInterceptor(decl, flagMeta, imp, decl.Type.Results != nil)
+		originals[decl] = originalDecl(decl, flagMeta.origName)
 
 		newList := make([]ast.Stmt, 0, len(decl.Body.List)+1)
 		newList = append(newList, &ast.IfStmt{
@@ -303,7 +516,7 @@ func injectInterceptors(flags funcFlags) {
 				Op: token.NEQ,
 				X: &ast.CallExpr{
 					Fun: &ast.SelectorExpr{
-						X:   ast.NewIdent("atomic"),
+						X:   ast.NewIdent(imp.atomic),
 						Sel: ast.NewIdent("LoadInt32"),
 					},
 					Args: []ast.Expr{&ast.UnaryExpr{
@@ -316,77 +529,109 @@ func injectInterceptors(flags funcFlags) {
 					Value: "0",
 				},
 			},
-			Body: &ast.BlockStmt{List: []ast.Stmt{interceptor}},
+			Body: &ast.BlockStmt{List: interceptor},
 		})
 		newList = append(newList, decl.Body.List...)
 		decl.Body.List = newList
 	}
+
+	return originals
 }
 
-func transformAst(filename string, fset *token.FileSet, f *ast.File) {
+// transformAst instruments the functions in the file and reports which functions were
+// instrumented and which were left as is.
+func transformAst(pkgPath string, fset *token.FileSet, f *ast.File) (res fileReport) {
 	flags := make(funcFlags)
-	var initFunc *ast.FuncDecl
 
-	pkgPrefix := strings.TrimLeft(strings.TrimPrefix(filepath.Dir(filename), gopath), string(os.PathSeparator)+"src"+string(os.PathSeparator))
+	ctxPkg := contextImportName(f)
+	imp := chooseImportNames(f)
 
 	for _, d := range f.Decls {
 		switch d := d.(type) {
 		case *ast.FuncDecl:
 			if d.Name.Name == "init" && d.Recv == nil {
-				initFunc = d
+				// init can't be referred to, so it can't be mocked either
+			} else if d.Name.Name == "_" {
+				res.Skipped = append(res.Skipped, skippedFunc{Name: getFuncDeclName(d, f.Name.Name), Reason: "blank name"})
+			} else if d.Body == nil {
+				res.Skipped = append(res.Skipped, skippedFunc{Name: getFuncDeclName(d, f.Name.Name), Reason: noBodyReason(d)})
+			} else if isGeneric(d) {
+				res.Skipped = append(res.Skipped, skippedFunc{Name: getFuncDeclName(d, f.Name.Name), Reason: "generic"})
 			} else if flName := funcDeclFlagName(fset, d); flName != "" {
-				var funcName string
-
-				if d.Recv != nil {
-					switch l := d.Recv.List[0].Type.(type) {
-					case *ast.StarExpr:
-						funcName = "*" + l.X.(*ast.Ident).Name
-					case *ast.Ident:
-						funcName = l.Name
-					}
-
-					funcName += "." + d.Name.Name
-				} else {
-					funcName = d.Name.Name
-				}
+				funcName := getFuncDeclName(d, f.Name.Name)
+				nameParams(d)
+				renameClashingParams(d, imp.hot, imp.atomic)
 
 				flags[d] = funcMeta{
 					flagName: flName,
-					funcName: pkgPrefix + "/" + funcName,
+					slotName: strings.Replace(flName, "softMocksFlag_", "softMocksSlot_", 1),
+					typeName: strings.Replace(flName, "softMocksFlag_", "softMocksType_", 1),
+					origName: strings.Replace(flName, "softMocksFlag_", "softOriginal_", 1),
+					ctxName:  contextParam(d, ctxPkg),
+					funcName: pkgPath + "/" + funcName,
 				}
 			}
 		}
 	}
 
-	injectInterceptors(flags)
+	// the copies of the functions and the other generated declarations must not get shims
+	addShims(f)
 
-	if len(flags) == 0 {
-		return
-	}
-
-	addSoftImport(fset, f)
-
-	if initFunc == nil {
-		initFunc = &ast.FuncDecl{
-			Name: ast.NewIdent("init"),
-			Type: &ast.FuncType{},
-			Body: &ast.BlockStmt{},
+	originals := injectInterceptors(flags, imp)
+	res.Instrumented = len(flags)
+	if len(originals) > 0 {
+		decls := make([]ast.Decl, 0, len(f.Decls)+len(originals))
+		for _, d := range f.Decls {
+			decls = append(decls, d)
+			if d, ok := d.(*ast.FuncDecl); ok && originals[d] != nil {
+				decls = append(decls, originals[d])
+			}
 		}
+		f.Decls = decls
+	}
 
-		f.Decls = append(f.Decls, initFunc)
+	if len(flags) == 0 {
+		return res
 	}
 
-	addInit(flags, initFunc, fset, f)
+	addSoftImport(f, imp)
+	addInit(flags, imp, f)
+	return res
 }
 
 // checks only exact package, not subpackages (because examples and the soft util itself live there)
-func isSoftPackage(filename string) bool {
-	return filepath.Dir(filename) == filepath.Join(gopath, "src", "github.com", "YuriyNasretdinov", "hotreload")
+func isSoftPackage(pkgPath string) bool {
+	return pkgPath == hotPkgPath
 }
 
-func rewriteFile(filename string) (contents []byte, err error) {
-	if !strings.HasSuffix(filename, ".go") || isSoftPackage(filename) {
-		return ioutil.ReadFile(filename)
+// rewriteFile returns the instrumented contents of the file and what was done to it.
+func rewriteFile(filename string) ([]byte, fileReport, error) {
+	contents, res, err := instrumentFile(filename)
+	if len(res.Skipped) > 0 {
+		var skipped []string
+		for _, s := range res.Skipped {
+			skipped = append(skipped, s.Name+" ("+s.Reason+")")
+		}
+		log.Printf("Functions in %s can't be mocked or reloaded on-the-fly: %s", filename, strings.Join(skipped, ", "))
+	}
+	return contents, res, err
+}
+
+// instrumentFile returns the instrumented contents of the file and what was done to it.
+func instrumentFile(filename string) (contents []byte, res fileReport, err error) {
+	if !strings.HasSuffix(filename, ".go") {
+		contents, err = ioutil.ReadFile(filename)
+		return contents, res, err
+	}
+
+	pkgPath, err := ws.importPath(filepath.Dir(filename))
+	if err != nil {
+		return nil, res, err
+	}
+
+	if isSoftPackage(pkgPath) {
+		contents, err = ioutil.ReadFile(filename)
+		return contents, res, err
 	}
 
 	defer func() {
@@ -395,20 +640,24 @@ func rewriteFile(filename string) (contents []byte, err error) {
 		}
 	}()
 
-	fset := token.NewFileSet() // positions are relative to fset
-	f, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
+	src, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil, err
+		return nil, res, err
 	}
 
-	cmap := ast.NewCommentMap(fset, f, f.Comments)
-	transformAst(filename, fset, f)
-	f.Comments = cmap.Filter(f).Comments()
+	fset := token.NewFileSet() // positions are relative to fset
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, res, err
+	}
 
-	var b bytes.Buffer
-	if err := printerCfg.Fprint(&b, fset, f); err != nil {
-		return nil, err
+	origDecls := make(map[ast.Decl]bool, len(f.Decls))
+	for _, d := range f.Decls {
+		origDecls[d] = true
 	}
 
-	return b.Bytes(), nil
+	res = transformAst(pkgPath, fset, f)
+
+	contents, err = spliceFile(filename, src, fset, f, origDecls)
+	return contents, res, err
 }
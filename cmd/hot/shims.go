@@ -0,0 +1,626 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Plugins are separate packages, so the reloaded code can't refer to unexported identifiers
+// of the package it comes from. To work around that the rewriter adds an exported "shim"
+// for every unexported package-level declaration when instrumenting the package:
+//
+//	func foo()             ->  var HotFunc_foo = foo
+//	func bar[T any](v T)   ->  func HotFunc_bar[T any](hotArg0 T) { bar[T](hotArg0) }
+//	func (t *T) m()        ->  var HotMethod_T_m = (*T).m
+//	var x int              ->  var HotVar_x = &x
+//	const c = 1            ->  const HotConst_c = c
+//	type t struct{ f int } ->  type HotType_t = t
+//	                           func (hotRecv *t) HotField_f() *int { return &hotRecv.f }
+//
+// and the code that goes into the plugin is rewritten to use them:
+//
+//	foo()      ->  pkg.HotFunc_foo()
+//	x          ->  (*pkg.HotVar_x)
+//	e.m()      ->  pkg.HotMethod_T_m(e)   (only for the receiver of the reloaded method)
+//	e.f        ->  (*e.HotField_f())      (only for the receiver of the reloaded method)
+//
+// Exported identifiers are just qualified with the package name.
+
+func shimName(kind, name string) string {
+	return "Hot" + kind + "_" + name
+}
+
+// methodShimName returns the name of the shim for the method. Names of types with underscores
+// are prefixed with their length, so that e.g. a_b.c and a.b_c get different shims.
+func methodShimName(typeName, name string) string {
+	if strings.Contains(typeName, "_") {
+		typeName = strconv.Itoa(len(typeName)) + typeName
+	}
+	return shimName("Method", typeName+"_"+name)
+}
+
+// recvTypeName returns the name of the receiver type of the method and whether or not
+// the receiver is a pointer. ok is false if the receiver is not a plain (non-generic) named type.
+func recvTypeName(d *ast.FuncDecl) (name string, pointer bool, ok bool) {
+	typ := d.Recv.List[0].Type
+	if star, isStar := typ.(*ast.StarExpr); isStar {
+		typ, pointer = star.X, true
+	}
+
+	if id, isIdent := typ.(*ast.Ident); isIdent {
+		return id.Name, pointer, true
+	}
+	return "", false, false
+}
+
+// pkgInfo lists package-level declarations of a package.
+type pkgInfo struct {
+	decls    map[string]token.Token         // all package-level names that can be referenced from plugins
+	methods  map[string]map[string]bool     // type name -> unexported methods
+	fields   map[string]map[string]ast.Expr // type name -> unexported fields with their types
+	generics map[string]*ast.FuncDecl       // unexported generic functions
+	types    map[string]ast.Expr            // type name -> type definition
+}
+
+func newPkgInfo() *pkgInfo {
+	return &pkgInfo{
+		decls:    make(map[string]token.Token),
+		methods:  make(map[string]map[string]bool),
+		fields:   make(map[string]map[string]ast.Expr),
+		generics: make(map[string]*ast.FuncDecl),
+		types:    make(map[string]ast.Expr),
+	}
+}
+
+func (p *pkgInfo) addFile(f *ast.File) {
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				if d.Name.Name == "init" || d.Name.Name == "_" {
+					continue
+				}
+				p.decls[d.Name.Name] = token.FUNC
+				if d.Type.TypeParams != nil && !ast.IsExported(d.Name.Name) {
+					p.generics[d.Name.Name] = d
+				}
+				continue
+			}
+
+			typeName, _, ok := recvTypeName(d)
+			if !ok || ast.IsExported(d.Name.Name) || d.Name.Name == "_" {
+				continue
+			}
+			if p.methods[typeName] == nil {
+				p.methods[typeName] = make(map[string]bool)
+			}
+			p.methods[typeName][d.Name.Name] = true
+		case *ast.GenDecl:
+			for _, sp := range d.Specs {
+				switch sp := sp.(type) {
+				case *ast.ValueSpec:
+					for _, n := range sp.Names {
+						if n.Name != "_" {
+							p.decls[n.Name] = d.Tok
+						}
+					}
+				case *ast.TypeSpec:
+					p.types[sp.Name.Name] = sp.Type
+					if sp.TypeParams != nil {
+						if ast.IsExported(sp.Name.Name) {
+							p.decls[sp.Name.Name] = token.TYPE
+						}
+						continue
+					}
+
+					p.decls[sp.Name.Name] = token.TYPE
+					p.addFields(sp)
+				}
+			}
+		}
+	}
+}
+
+func (p *pkgInfo) addFields(sp *ast.TypeSpec) {
+	// methods can't be declared on aliases of unnamed types
+	st, ok := sp.Type.(*ast.StructType)
+	if !ok || sp.Assign.IsValid() {
+		return
+	}
+
+	for _, fl := range st.Fields.List {
+		for _, n := range fl.Names {
+			if ast.IsExported(n.Name) || n.Name == "_" {
+				continue
+			}
+			if p.fields[sp.Name.Name] == nil {
+				p.fields[sp.Name.Name] = make(map[string]ast.Expr)
+			}
+			p.fields[sp.Name.Name][n.Name] = fl.Type
+		}
+	}
+}
+
+// parsePkgInfo collects declarations of the package pkgName from the Go files in dir
+// that match the current build constraints.
+func parsePkgInfo(dir, pkgName string) (*pkgInfo, error) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), dir, func(fi os.FileInfo) bool {
+		ok, err := build.Default.MatchFile(dir, fi.Name())
+		return ok && err == nil
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info := newPkgInfo()
+	if pkg, ok := pkgs[pkgName]; ok {
+		for _, f := range pkg.Files {
+			info.addFile(f)
+		}
+	}
+	return info, nil
+}
+
+func sortedKeys(m interface{}) []string {
+	var res []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		res = append(res, k.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+// addShims adds exported shims for the unexported declarations of the file.
+func addShims(f *ast.File) {
+	info := newPkgInfo()
+	info.addFile(f)
+
+	vars := &ast.GenDecl{Tok: token.VAR}
+	consts := &ast.GenDecl{Tok: token.CONST}
+	var decls []ast.Decl
+
+	for _, name := range sortedKeys(info.decls) {
+		if ast.IsExported(name) {
+			continue
+		}
+
+		switch tok := info.decls[name]; tok {
+		case token.FUNC:
+			// generic functions can't be assigned to variables without instantiating them
+			if d := info.generics[name]; d != nil {
+				decls = append(decls, genericFuncShim(d))
+				continue
+			}
+
+			vars.Specs = append(vars.Specs, &ast.ValueSpec{
+				Names:  []*ast.Ident{ast.NewIdent(shimName("Func", name))},
+				Values: []ast.Expr{ast.NewIdent(name)},
+			})
+		case token.VAR:
+			vars.Specs = append(vars.Specs, &ast.ValueSpec{
+				Names:  []*ast.Ident{ast.NewIdent(shimName("Var", name))},
+				Values: []ast.Expr{&ast.UnaryExpr{Op: token.AND, X: ast.NewIdent(name)}},
+			})
+		case token.CONST:
+			consts.Specs = append(consts.Specs, &ast.ValueSpec{
+				Names:  []*ast.Ident{ast.NewIdent(shimName("Const", name))},
+				Values: []ast.Expr{ast.NewIdent(name)},
+			})
+		case token.TYPE:
+			decls = append(decls, &ast.GenDecl{
+				Tok: token.TYPE,
+				Specs: []ast.Spec{&ast.TypeSpec{
+					Name:   ast.NewIdent(shimName("Type", name)),
+					Assign: 1,
+					Type:   ast.NewIdent(name),
+				}},
+			})
+		}
+	}
+
+	for _, typeName := range sortedKeys(info.methods) {
+		for _, name := range sortedKeys(info.methods[typeName]) {
+			vars.Specs = append(vars.Specs, &ast.ValueSpec{
+				Names: []*ast.Ident{ast.NewIdent(methodShimName(typeName, name))},
+				Values: []ast.Expr{&ast.SelectorExpr{
+					X:   &ast.ParenExpr{X: &ast.StarExpr{X: ast.NewIdent(typeName)}},
+					Sel: ast.NewIdent(name),
+				}},
+			})
+		}
+	}
+
+	for _, typeName := range sortedKeys(info.fields) {
+		for _, name := range sortedKeys(info.fields[typeName]) {
+			// func (hotRecv *T) HotField_f() *<type> { return &hotRecv.f }
+			decls = append(decls, &ast.FuncDecl{
+				Recv: &ast.FieldList{List: []*ast.Field{{
+					Names: []*ast.Ident{ast.NewIdent("hotRecv")},
+					Type:  &ast.StarExpr{X: ast.NewIdent(typeName)},
+				}}},
+				Name: ast.NewIdent(shimName("Field", name)),
+				Type: &ast.FuncType{
+					Params: &ast.FieldList{},
+					Results: &ast.FieldList{List: []*ast.Field{{
+						Type: &ast.StarExpr{X: info.fields[typeName][name]},
+					}}},
+				},
+				Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{
+					Results: []ast.Expr{&ast.UnaryExpr{
+						Op: token.AND,
+						X: &ast.SelectorExpr{
+							X:   ast.NewIdent("hotRecv"),
+							Sel: ast.NewIdent(name),
+						},
+					}},
+				}}},
+			})
+		}
+	}
+
+	if len(consts.Specs) > 0 {
+		f.Decls = append(f.Decls, consts)
+	}
+	if len(vars.Specs) > 0 {
+		f.Decls = append(f.Decls, vars)
+	}
+	f.Decls = append(f.Decls, decls...)
+}
+
+// genericFuncShim returns the exported generic function that calls the generic function d
+// with the same type parameters:
+//
+//	func HotFunc_foo[K comparable, V any](hotArg0 map[K]V, hotArg1 ...K) V { return foo[K, V](hotArg0, hotArg1...) }
+func genericFuncShim(d *ast.FuncDecl) *ast.FuncDecl {
+	var typeArgs []ast.Expr
+	for _, fl := range d.Type.TypeParams.List {
+		for _, n := range fl.Names {
+			typeArgs = append(typeArgs, ast.NewIdent(n.Name))
+		}
+	}
+
+	var fun ast.Expr
+	if len(typeArgs) == 1 {
+		fun = &ast.IndexExpr{X: ast.NewIdent(d.Name.Name), Index: typeArgs[0]}
+	} else {
+		fun = &ast.IndexListExpr{X: ast.NewIdent(d.Name.Name), Indices: typeArgs}
+	}
+	call := &ast.CallExpr{Fun: fun}
+
+	// parameters are renamed because they can be unnamed or called "_"
+	params := &ast.FieldList{}
+	for _, fl := range d.Type.Params.List {
+		n := len(fl.Names)
+		if n == 0 {
+			n = 1
+		}
+
+		for i := 0; i < n; i++ {
+			name := ast.NewIdent(fmt.Sprintf("hotArg%d", len(call.Args)))
+			params.List = append(params.List, &ast.Field{Names: []*ast.Ident{name}, Type: fl.Type})
+			call.Args = append(call.Args, name)
+		}
+
+		if _, ok := fl.Type.(*ast.Ellipsis); ok {
+			call.Ellipsis = 1
+		}
+	}
+
+	var results *ast.FieldList
+	var body ast.Stmt = &ast.ExprStmt{X: call}
+	if d.Type.Results != nil {
+		results = &ast.FieldList{}
+		for _, fl := range d.Type.Results.List {
+			n := len(fl.Names)
+			if n == 0 {
+				n = 1
+			}
+
+			for i := 0; i < n; i++ {
+				results.List = append(results.List, &ast.Field{Type: fl.Type})
+			}
+		}
+		body = &ast.ReturnStmt{Results: []ast.Expr{call}}
+	}
+
+	return &ast.FuncDecl{
+		Name: ast.NewIdent(shimName("Func", d.Name.Name)),
+		Type: &ast.FuncType{
+			TypeParams: d.Type.TypeParams,
+			Params:     params,
+			Results:    results,
+		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{body}},
+	}
+}
+
+var exprType = reflect.TypeOf((*ast.Expr)(nil)).Elem()
+var nodeType = reflect.TypeOf((*ast.Node)(nil)).Elem()
+
+// replaceExprs calls fn for every expression in the tree rooted at n, parents first,
+// and replaces the expression with the one that fn returns. Children of the returned
+// expression are visited only if fn says so. Declared names and selectors in selector
+// expressions are not expressions and so are not visited.
+func replaceExprs(n ast.Node, fn func(ast.Expr) (ast.Expr, bool)) {
+	replaceInValue(reflect.ValueOf(n), fn)
+}
+
+func replaceInValue(v reflect.Value, fn func(ast.Expr) (ast.Expr, bool)) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || !v.Type().Implements(nodeType) {
+			return
+		}
+
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			replaceInField(v.Field(i), fn)
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			replaceInValue(v.Elem(), fn)
+		}
+	}
+}
+
+func replaceInField(v reflect.Value, fn func(ast.Expr) (ast.Expr, bool)) {
+	switch {
+	case v.Type() == exprType:
+		replaceExpr(v, fn)
+	case v.Kind() == reflect.Slice && v.Type().Elem() == exprType:
+		for i := 0; i < v.Len(); i++ {
+			replaceExpr(v.Index(i), fn)
+		}
+	case v.Kind() == reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			replaceInValue(v.Index(i), fn)
+		}
+	default:
+		replaceInValue(v, fn)
+	}
+}
+
+func replaceExpr(v reflect.Value, fn func(ast.Expr) (ast.Expr, bool)) {
+	if v.IsNil() {
+		return
+	}
+
+	r, descend := fn(v.Interface().(ast.Expr))
+	v.Set(reflect.ValueOf(r))
+	if descend {
+		replaceInValue(v, fn)
+	}
+}
+
+// qualifier rewrites the code that is moved into a plugin to refer to the declarations
+// of the original package through the package name, using shims for the unexported ones.
+type qualifier struct {
+	info     *pkgInfo
+	pkgName  string               // name under which the original package is imported
+	topLevel map[interface{}]bool // top-level declarations of the file
+	local    map[string]bool      // package-level names that are declared in the plugin itself
+	recv     *ast.Object          // receiver of the method that is being rewritten
+	recvType string               // type name of the receiver
+	recvPtr  bool                 // whether or not the receiver is a pointer
+
+	// composite literals in which keys are expressions rather than field names
+	exprKeys map[*ast.CompositeLit]bool
+}
+
+func newQualifier(info *pkgInfo, pkgName string, f *ast.File, local map[string]bool) *qualifier {
+	q := &qualifier{
+		info:     info,
+		pkgName:  pkgName,
+		topLevel: make(map[interface{}]bool),
+		local:    local,
+	}
+
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			q.topLevel[d] = true
+		case *ast.GenDecl:
+			for _, sp := range d.Specs {
+				q.topLevel[sp] = true
+			}
+		}
+	}
+	return q
+}
+
+// qualifyFuncDecl rewrites the function (including it's signature) so that it can be compiled in the plugin.
+func (q *qualifier) qualifyFuncDecl(d *ast.FuncDecl) {
+	q.recv = nil
+	if d.Recv != nil {
+		if names := d.Recv.List[0].Names; len(names) > 0 {
+			q.recv = names[0].Obj
+		}
+		q.recvType, q.recvPtr, _ = recvTypeName(d)
+	}
+
+	// types of the literals must be determined before they are qualified
+	q.exprKeys = make(map[*ast.CompositeLit]bool)
+	ast.Inspect(d, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.CompositeLit); ok && lit.Type != nil {
+			q.markLit(lit, lit.Type)
+		}
+		return true
+	})
+
+	replaceExprs(d, q.qualify)
+}
+
+// underlying returns the definition of the type as far as it is known.
+func (q *qualifier) underlying(typ ast.Expr) ast.Expr {
+	seen := make(map[string]bool)
+	for {
+		switch t := typ.(type) {
+		case *ast.ParenExpr:
+			typ = t.X
+		case *ast.IndexExpr:
+			typ = t.X
+		case *ast.IndexListExpr:
+			typ = t.X
+		case *ast.Ident:
+			if seen[t.Name] {
+				return typ
+			}
+			seen[t.Name] = true
+
+			if t.Obj != nil {
+				sp, ok := t.Obj.Decl.(*ast.TypeSpec)
+				if !ok {
+					return typ
+				}
+				typ = sp.Type
+			} else if def, ok := q.info.types[t.Name]; ok {
+				typ = def
+			} else {
+				return typ
+			}
+		default:
+			return typ
+		}
+	}
+}
+
+// markLit records whether keys in the literal of type typ and in the literals nested in
+// it with elided types are expressions. Literals of unknown types are assumed to be structs.
+func (q *qualifier) markLit(lit *ast.CompositeLit, typ ast.Expr) {
+	var keyType, elemType ast.Expr
+	switch t := q.underlying(typ).(type) {
+	case *ast.MapType:
+		keyType, elemType = t.Key, t.Value
+	case *ast.ArrayType:
+		elemType = t.Elt
+	default:
+		return
+	}
+
+	q.exprKeys[lit] = true
+	for _, elt := range lit.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			q.markElided(kv.Key, keyType)
+			elt = kv.Value
+		}
+		q.markElided(elt, elemType)
+	}
+}
+
+// markElided calls markLit for the element of type typ if it is a literal with elided type.
+func (q *qualifier) markElided(e, typ ast.Expr) {
+	lit, ok := e.(*ast.CompositeLit)
+	if !ok || lit.Type != nil || typ == nil {
+		return
+	}
+
+	// &T{...} can be elided to {...} too
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	q.markLit(lit, typ)
+}
+
+func (q *qualifier) pkgSelector(name string) ast.Expr {
+	return &ast.SelectorExpr{X: ast.NewIdent(q.pkgName), Sel: ast.NewIdent(name)}
+}
+
+func (q *qualifier) isRecv(e ast.Expr) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && q.recv != nil && id.Obj == q.recv
+}
+
+// qualifyTree rewrites the expression e and all of it's children.
+func (q *qualifier) qualifyTree(e ast.Expr) ast.Expr {
+	r, descend := q.qualify(e)
+	if descend {
+		replaceExprs(r, q.qualify)
+	}
+	return r
+}
+
+func (q *qualifier) qualify(e ast.Expr) (ast.Expr, bool) {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return q.qualifyIdent(e), false
+	case *ast.CallExpr:
+		sel, ok := e.Fun.(*ast.SelectorExpr)
+		if !ok || !q.isRecv(sel.X) || !q.info.methods[q.recvType][sel.Sel.Name] {
+			return e, true
+		}
+
+		// e.m(args) -> pkg.HotMethod_T_m(e, args)
+		var recvArg ast.Expr = sel.X
+		if !q.recvPtr {
+			recvArg = &ast.UnaryExpr{Op: token.AND, X: sel.X}
+		}
+
+		args := []ast.Expr{recvArg}
+		for _, arg := range e.Args {
+			args = append(args, q.qualifyTree(arg))
+		}
+
+		return &ast.CallExpr{
+			Fun:      q.pkgSelector(methodShimName(q.recvType, sel.Sel.Name)),
+			Args:     args,
+			Ellipsis: e.Ellipsis,
+		}, false
+	case *ast.SelectorExpr:
+		if !q.isRecv(e.X) || q.info.fields[q.recvType][e.Sel.Name] == nil {
+			return e, true
+		}
+
+		// e.f -> (*e.HotField_f())
+		return &ast.ParenExpr{X: &ast.StarExpr{X: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{X: e.X, Sel: ast.NewIdent(shimName("Field", e.Sel.Name))},
+		}}}, false
+	case *ast.CompositeLit:
+		if e.Type != nil {
+			e.Type = q.qualifyTree(e.Type)
+		}
+
+		for i, elt := range e.Elts {
+			// keys in struct literals are field names rather than references to declarations
+			if kv, ok := elt.(*ast.KeyValueExpr); ok && !q.exprKeys[e] {
+				kv.Value = q.qualifyTree(kv.Value)
+				continue
+			}
+			e.Elts[i] = q.qualifyTree(elt)
+		}
+		return e, false
+	}
+
+	return e, true
+}
+
+func (q *qualifier) qualifyIdent(id *ast.Ident) ast.Expr {
+	tok, ok := q.info.decls[id.Name]
+	if !ok || q.local[id.Name] || (id.Obj != nil && !q.topLevel[id.Obj.Decl]) {
+		return id
+	}
+
+	if ast.IsExported(id.Name) {
+		return q.pkgSelector(id.Name)
+	}
+
+	switch tok {
+	case token.FUNC:
+		return q.pkgSelector(shimName("Func", id.Name))
+	case token.VAR:
+		return &ast.ParenExpr{X: &ast.StarExpr{X: q.pkgSelector(shimName("Var", id.Name))}}
+	case token.CONST:
+		return q.pkgSelector(shimName("Const", id.Name))
+	case token.TYPE:
+		return q.pkgSelector(shimName("Type", id.Name))
+	}
+
+	return id
+}
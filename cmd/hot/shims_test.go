@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+func parseSource(t *testing.T, src string) (*token.FileSet, *ast.File) {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "a.go", src, 0)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return fset, f
+}
+
+func formatNode(t *testing.T, fset *token.FileSet, n interface{}) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := format.Node(&b, fset, n); err != nil {
+		t.Fatalf("format: %v", err)
+	}
+
+	// nodes without positions are printed differently from the parsed ones
+	res, err := format.Source(b.Bytes())
+	if err != nil {
+		t.Fatalf("format %s: %v", b.String(), err)
+	}
+	return string(res)
+}
+
+func formatSource(t *testing.T, src string) string {
+	t.Helper()
+
+	res, err := format.Source([]byte(src))
+	if err != nil {
+		t.Fatalf("format %s: %v", src, err)
+	}
+	return string(res)
+}
+
+func TestAddShims(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string // declarations that are appended to src
+	}{
+		{
+			name: "func",
+			src:  "func foo() {}",
+			want: "var HotFunc_foo = foo",
+		},
+		{
+			name: "exported and special funcs",
+			src:  "func Foo() {}\nfunc init() {}\nfunc _() {}",
+			want: "",
+		},
+		{
+			name: "var",
+			src:  "var x, _, Y int",
+			want: "var HotVar_x = &x",
+		},
+		{
+			name: "const",
+			src:  "const (\n\tc = iota\n\tD\n)",
+			want: "const HotConst_c = c",
+		},
+		{
+			name: "type with private field",
+			src:  "type t struct {\n\tf    []int\n\tG, _ string\n}",
+			want: "type HotType_t = t\n\nfunc (hotRecv *t) HotField_f() *[]int {\n\treturn &hotRecv.f\n}",
+		},
+		{
+			name: "methods",
+			src:  "type T struct{}\n\nfunc (t *T) m() {}\nfunc (T) n() {}\nfunc (t *T) Exported() {}",
+			want: "var (\n\tHotMethod_T_m = (*T).m\n\tHotMethod_T_n = (*T).n\n)",
+		},
+		{
+			name: "alias of struct",
+			src:  "type t = struct{ f int }",
+			want: "type HotType_t = t",
+		},
+		{
+			name: "methods of types with underscores",
+			src:  "type A_b struct{}\ntype A struct{}\n\nfunc (A_b) c() {}\nfunc (A) b_c() {}",
+			want: "var (\n\tHotMethod_A_b_c  = (*A).b_c\n\tHotMethod_3A_b_c = (*A_b).c\n)",
+		},
+		{
+			name: "generic func",
+			src:  "func bar[K comparable, V any](m map[K]V, _ ...K) V { return m[*new(K)] }",
+			want: "func HotFunc_bar[K comparable, V any](hotArg0 map[K]V, hotArg1 ...K) V {\n\treturn bar[K, V](hotArg0, hotArg1...)\n}",
+		},
+		{
+			name: "generic func without results",
+			src:  "func each[T any](T, func(T)) {}",
+			want: "func HotFunc_each[T any](hotArg0 T, hotArg1 func(T)) {\n\teach[T](hotArg0, hotArg1)\n}",
+		},
+		{
+			name: "generic types are skipped",
+			src:  "type list[T any] []T\n\nfunc (l list[T]) size() int { return len(l) }",
+			want: "",
+		},
+		{
+			name: "order",
+			src:  "type u int\n\nvar b int\n\nconst a = 1\n\nfunc c() {}",
+			want: "const HotConst_a = a\n\nvar (\n\tHotVar_b  = &b\n\tHotFunc_c = c\n)\n\ntype HotType_u = u",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset, f := parseSource(t, "package p\n\n"+tt.src+"\n")
+			n := len(f.Decls)
+			addShims(f)
+
+			want := formatSource(t, "package p\n\n"+tt.want+"\n")
+			got := formatNode(t, fset, &ast.File{Name: ast.NewIdent("p"), Decls: f.Decls[n:]})
+			if got != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestQualifyFuncDecl(t *testing.T) {
+	const pkg = `package p
+
+type T struct {
+	n      int
+	Public int
+}
+
+func (t *T) inc() {}
+
+type item struct{}
+
+var count int
+
+var Total int
+
+const limit = 10
+
+const key = "k"
+
+type table map[string]int
+
+func helper() int { return 1 }
+
+func max[V int | float64](a, b V) V {
+	if a > b {
+		return a
+	}
+	return b
+}
+`
+
+	tests := []struct {
+		name  string
+		src   string // the last function is the one that is rewritten
+		local []string
+		want  string
+	}{
+		{
+			name: "private func",
+			src:  "func F() int { return helper() }",
+			want: "func F() int { return p.HotFunc_helper() }",
+		},
+		{
+			name: "private var",
+			src:  "func F() { count++ }",
+			want: "func F() { (*p.HotVar_count)++ }",
+		},
+		{
+			name: "private const",
+			src:  "func F() int { return limit }",
+			want: "func F() int { return p.HotConst_limit }",
+		},
+		{
+			name: "private type",
+			src:  "func F() *item { return new(item) }",
+			want: "func F() *p.HotType_item { return new(p.HotType_item) }",
+		},
+		{
+			name: "exported",
+			src:  "func F(t T) int { return Total + t.Public }",
+			want: "func F(t p.T) int { return p.Total + t.Public }",
+		},
+		{
+			name: "generic func",
+			src:  "func F() int { return max(1, max[int](2, 3)) }",
+			want: "func F() int { return p.HotFunc_max(1, p.HotFunc_max[int](2, 3)) }",
+		},
+		{
+			name: "local variable",
+			src:  "func F(helper int) { count := helper; _ = count }",
+			want: "func F(helper int) { count := helper; _ = count }",
+		},
+		{
+			name:  "function declared in the plugin",
+			src:   "func helper2() {}\n\nfunc F() { helper2() }",
+			local: []string{"helper2"},
+			want:  "func F() { helper2() }",
+		},
+		{
+			name: "receiver",
+			src:  "func (t *T) F() { t.inc(); t.n++ }",
+			want: "func (t *p.T) F() { p.HotMethod_T_inc(t); (*t.HotField_n())++ }",
+		},
+		{
+			name: "value receiver",
+			src:  "func (t T) F() int { t.inc(); return t.n }",
+			want: "func (t p.T) F() int { p.HotMethod_T_inc(&t); return (*t.HotField_n()) }",
+		},
+		{
+			name: "method arguments",
+			src:  "func (t *T) F() { t.inc(helper(), count) }",
+			want: "func (t *p.T) F() { p.HotMethod_T_inc(t, p.HotFunc_helper(), (*p.HotVar_count)) }",
+		},
+		{
+			// private fields of anything but the receiver are not supported
+			name: "field of other variable",
+			src:  "func F(t *T) int { return t.n }",
+			want: "func F(t *p.T) int { return t.n }",
+		},
+		{
+			// private methods of anything but the receiver are not supported
+			name: "method of other variable",
+			src:  "func (t *T) F(o *T) { o.inc() }",
+			want: "func (t *p.T) F(o *p.T) { o.inc() }",
+		},
+		{
+			// private fields can't be set in struct literals
+			name: "struct literal",
+			src:  "func F() *T { return &T{n: count, Public: limit} }",
+			want: "func F() *p.T { return &p.T{n: (*p.HotVar_count), Public: p.HotConst_limit} }",
+		},
+		{
+			name: "map literal",
+			src:  "func F() map[string]int { return map[string]int{key: limit} }",
+			want: "func F() map[string]int { return map[string]int{p.HotConst_key: p.HotConst_limit} }",
+		},
+		{
+			name: "named map literal",
+			src:  "func F() table { return table{key: limit} }",
+			want: "func F() p.HotType_table { return p.HotType_table{p.HotConst_key: p.HotConst_limit} }",
+		},
+		{
+			name: "local map type",
+			src:  "func F() { type m map[string]int; _ = m{key: 1} }",
+			want: "func F() { type m map[string]int; _ = m{p.HotConst_key: 1} }",
+		},
+		{
+			name: "array indices",
+			src:  "func F() []int { return []int{limit: 1} }",
+			want: "func F() []int { return []int{p.HotConst_limit: 1} }",
+		},
+		{
+			name: "elided struct literals",
+			src:  "func F() []*T { return []*T{{n: 1, Public: limit}} }",
+			want: "func F() []*p.T { return []*p.T{{n: 1, Public: p.HotConst_limit}} }",
+		},
+		{
+			name: "elided map literals",
+			src:  "func F() map[string][]table { return map[string][]table{key: {{key: limit}}} }",
+			want: "func F() map[string][]p.HotType_table { return map[string][]p.HotType_table{p.HotConst_key: {{p.HotConst_key: p.HotConst_limit}}} }",
+		},
+		{
+			name: "elided keys",
+			src:  "func F() map[T]bool { return map[T]bool{{Public: limit}: true} }",
+			want: "func F() map[p.T]bool { return map[p.T]bool{{Public: p.HotConst_limit}: true} }",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := newPkgInfo()
+			_, pf := parseSource(t, pkg)
+			info.addFile(pf)
+
+			fset, f := parseSource(t, pkg+"\n"+tt.src+"\n")
+			local := make(map[string]bool)
+			for _, name := range tt.local {
+				local[name] = true
+			}
+
+			d := f.Decls[len(f.Decls)-1].(*ast.FuncDecl)
+			newQualifier(info, "p", f, local).qualifyFuncDecl(d)
+
+			want := formatSource(t, "package p\n\n"+tt.want+"\n")
+			got := formatNode(t, fset, &ast.File{Name: ast.NewIdent("p"), Decls: []ast.Decl{d}})
+			if got != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// edit replaces src[off:end] of the original source with text.
+type edit struct {
+	off  int
+	end  int
+	text string
+}
+
+// spliceFile applies the changes that transformAst made to the declarations of the file to
+// it's original source and appends the declarations that were added. Unlike printing the
+// whole AST it keeps every line of the original code on the same line, so coverage profiles
+// (which ignore //line directives) stay correct. The code is attributed to the original file
+// in stack traces and debuggers even when the instrumented copy lives somewhere else.
+// origDecls are the declarations the file had before it was transformed.
+// Files that were not changed by transformAst are returned as is.
+func spliceFile(filename string, src []byte, fset *token.FileSet, f *ast.File, origDecls map[ast.Decl]bool) ([]byte, error) {
+	tf := fset.File(f.Package)
+	pos := fset.PositionFor(f.Package, false)
+
+	edits := []edit{{
+		off:  tf.Offset(f.Package),
+		end:  tf.Offset(f.Package),
+		text: fmt.Sprintf("/*line %s:%d:%d*/", filename, pos.Line, pos.Column),
+	}}
+
+	var added []ast.Decl
+	for _, d := range f.Decls {
+		if origDecls[d] {
+			if d, ok := d.(*ast.FuncDecl); ok {
+				fEdits, err := funcEdits(src, fset, tf, d)
+				if err != nil {
+					return nil, err
+				}
+				edits = append(edits, fEdits...)
+			}
+			continue
+		}
+
+		if d, ok := d.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			// imports must precede the other declarations, so they go right after the package clause
+			var b bytes.Buffer
+			if err := printer.Fprint(&b, fset, d); err != nil {
+				return nil, err
+			}
+			off := tf.Offset(f.Name.End())
+			edits = append(edits, edit{off: off, end: off, text: "; " + b.String()})
+			continue
+		}
+
+		added = append(added, d)
+	}
+
+	if len(edits) == 1 && len(added) == 0 {
+		// there is nothing to attribute to the original file
+		return src, nil
+	}
+
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].off < edits[j].off })
+
+	var b bytes.Buffer
+	last := 0
+	for _, e := range edits {
+		if e.off < last {
+			// the same identifier can be visited more than once
+			continue
+		}
+		b.Write(src[last:e.off])
+		b.WriteString(e.text)
+		last = e.end
+	}
+	b.Write(src[last:])
+
+	for _, d := range added {
+		b.WriteString("\n\n")
+
+		cfg := printerCfg
+		if !hasPos(d) {
+			// the printer can't attribute such declarations to any file on it's own
+			fmt.Fprintf(&b, "//line %s:%d\n", filename, pos.Line)
+			cfg = &printer.Config{Tabwidth: printerCfg.Tabwidth}
+		}
+		if err := cfg.Fprint(&b, fset, d); err != nil {
+			return nil, err
+		}
+	}
+	b.WriteString("\n")
+
+	return b.Bytes(), nil
+}
+
+// funcEdits returns the edits that give the original source of the function the names
+// that were given to it's arguments and the interceptor.
+func funcEdits(src []byte, fset *token.FileSet, tf *token.File, d *ast.FuncDecl) ([]edit, error) {
+	var edits []edit
+
+	fields := d.Type.Params.List
+	if d.Recv != nil {
+		fields = append([]*ast.Field{d.Recv.List[0]}, fields...)
+	}
+	for _, fl := range fields {
+		if len(fl.Names) == 0 || fl.Names[0].Pos().IsValid() {
+			continue
+		}
+		// the argument was unnamed
+		off := tf.Offset(fl.Type.Pos())
+		edits = append(edits, edit{off: off, end: off, text: fl.Names[0].Name + " "})
+	}
+
+	ast.Inspect(d, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || !id.Pos().IsValid() {
+			return true
+		}
+		off := tf.Offset(id.Pos())
+		if old := identAt(src, off); old != id.Name {
+			edits = append(edits, edit{off: off, end: off + len(old), text: id.Name})
+		}
+		return true
+	})
+
+	if d.Body == nil {
+		return edits, nil
+	}
+
+	var b bytes.Buffer
+	for _, stmt := range d.Body.List {
+		if stmt.Pos().IsValid() {
+			break
+		}
+		if err := printer.Fprint(&b, fset, stmt); err != nil {
+			return nil, err
+		}
+		b.WriteString("\n")
+	}
+	if b.Len() > 0 {
+		off := tf.Offset(d.Body.Lbrace) + 1
+		edits = append(edits, edit{off: off, end: off, text: " " + singleLine(b.String())})
+	}
+
+	return edits, nil
+}
+
+// hasPos reports whether the node has any positions in the original source.
+func hasPos(n ast.Node) bool {
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		if n != nil && n.Pos().IsValid() {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// identAt returns the identifier that starts at the offset.
+func identAt(src []byte, off int) string {
+	end := off
+	for end < len(src) {
+		r, size := utf8.DecodeRune(src[end:])
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		end += size
+	}
+	return string(src[off:end])
+}
+
+// singleLine joins the lines of the printed statements so that they can be inserted
+// into the original code without moving it to other lines.
+func singleLine(code string) string {
+	var b strings.Builder
+	for _, ln := range strings.Split(code, "\n") {
+		ln = strings.TrimSpace(ln)
+		if ln == "" {
+			continue
+		}
+		b.WriteString(ln)
+		if strings.HasSuffix(ln, "{") {
+			b.WriteString(" ")
+		} else {
+			b.WriteString("; ")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// instrumentSource instruments the source as a file of the package example.com/p.
+func instrumentSource(t *testing.T, src string) (filename string, contents []byte, res fileReport) {
+	t.Helper()
+
+	dir := t.TempDir()
+	oldWs := ws
+	t.Cleanup(func() { ws = oldWs })
+	ws = &workspace{}
+	ws.addTree(dir, "example.com/p")
+
+	filename = filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(filename, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, res, err := instrumentFile(filename)
+	if err != nil {
+		t.Fatalf("instrumentFile: %v", err)
+	}
+	return filename, contents, res
+}
+
+func TestInstrumentFileKeepsLines(t *testing.T) {
+	const src = `package p
+
+import "fmt"
+
+// F prints
+func F(a int, _ string) (int, error) {
+	if a > 0 {
+		return a, nil
+	}
+	return 0, fmt.Errorf("x")
+}
+
+func (T) m(int, bool) {}
+
+type T struct{}
+`
+
+	filename, contents, res := instrumentSource(t, src)
+	if res.Instrumented != 2 {
+		t.Errorf("%d functions were instrumented, want 2", res.Instrumented)
+	}
+
+	origLines := strings.Split(src, "\n")
+	lines := strings.Split(string(contents), "\n")
+
+	prefixes := map[int]string{
+		1:  "/*line " + filename + ":1:1*/package p; import ",
+		6:  "func F(a int, hotArg1 string) (int, error) { if ",
+		13: "func (hotRecv T) m(hotArg0 int, hotArg1 bool) { if ",
+	}
+	for i, orig := range origLines[:len(origLines)-1] {
+		ln := i + 1
+		if prefix, ok := prefixes[ln]; ok {
+			if !strings.HasPrefix(lines[i], prefix) {
+				t.Errorf("line %d = %q, want it to start with %q", ln, lines[i], prefix)
+			}
+		} else if lines[i] != orig {
+			t.Errorf("line %d = %q, want %q", ln, lines[i], orig)
+		}
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filepath.Join(t.TempDir(), "a.go"), contents, 0)
+	if err != nil {
+		t.Fatalf("instrumented file does not parse: %v\n%s", err, contents)
+	}
+
+	// the functions and their original copies are attributed to the original file
+	var got []string
+	for _, d := range f.Decls {
+		if d, ok := d.(*ast.FuncDecl); ok && d.Name.Name != "init" {
+			pos := fset.Position(d.Pos())
+			got = append(got, fmt.Sprintf("%s:%d", pos.Filename, pos.Line))
+		}
+	}
+
+	want := []string{filename + ":6", filename + ":13", filename + ":6", filename + ":13"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("functions are at %v, want %v", got, want)
+	}
+}
+
+func TestInstrumentFileWithoutChanges(t *testing.T) {
+	const src = "package p\n\n// T is exported.\ntype T struct{ N int }\n\nfunc init() {}\n"
+
+	_, contents, res := instrumentSource(t, src)
+	if !bytes.Equal(contents, []byte(src)) {
+		t.Errorf("file without functions was changed:\n%s", contents)
+	}
+	if res.Instrumented != 0 {
+		t.Errorf("%d functions were instrumented, want 0", res.Instrumented)
+	}
+}
+
+func TestInstrumentFileSkipsBlankFuncs(t *testing.T) {
+	const src = "package p\n\ntype T struct{}\n\nfunc _() {}\n\nfunc (T) _() {}\n"
+
+	_, contents, res := instrumentSource(t, src)
+	if !bytes.Equal(contents, []byte(src)) {
+		t.Errorf("file with blank functions only was changed:\n%s", contents)
+	}
+
+	want := []skippedFunc{{Name: "_", Reason: "blank name"}, {Name: "T._", Reason: "blank name"}}
+	if !reflect.DeepEqual(res.Skipped, want) {
+		t.Errorf("skipped %+v, want %+v", res.Skipped, want)
+	}
+}
+
+func TestInstrumentFileKeepsParamNames(t *testing.T) {
+	const src = `package p
+
+type file struct{}
+
+func (file *file) close(softMocksHot int) error { return nil }
+`
+
+	_, contents, _ := instrumentSource(t, src)
+	if !strings.Contains(string(contents), "func (file *file) close(hotParam_softMocksHot int) error {") {
+		t.Errorf("only the parameters that clash with the imports must be renamed:\n%s", contents)
+	}
+}
+
+func TestSingleLine(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"x()\n", "x(); "},
+		{"if x {\n\treturn\n}\ny()\n", "if x { return; }; y(); "},
+		{"\n\tif a {\n\n\t\tb()\n\t}\n", "if a { b(); }; "},
+	}
+
+	for _, tt := range tests {
+		if got := singleLine(tt.code); got != tt.want {
+			t.Errorf("singleLine(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestIdentAt(t *testing.T) {
+	tests := []struct {
+		src  string
+		off  int
+		want string
+	}{
+		{"foo_1(x)", 0, "foo_1"},
+		{"foo_1(x)", 6, "x"},
+		{"foo_1(x)", 5, ""},
+		{"a, _ int", 3, "_"},
+		{"имя int", 0, "имя"},
+		{"end", 3, ""},
+	}
+
+	for _, tt := range tests {
+		if got := identAt([]byte(tt.src), tt.off); got != tt.want {
+			t.Errorf("identAt(%q, %d) = %q, want %q", tt.src, tt.off, got, tt.want)
+		}
+	}
+}
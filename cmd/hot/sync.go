@@ -61,7 +61,8 @@ func sync(fi os.FileInfo, dirFrom, dirTo string) {
 		return
 	}
 
-	newContents, err := rewriteFile(from)
+	newContents, res, err := rewriteFile(from)
+	recordResult(fi, from, to, res, err)
 	if err != nil {
 		log.Printf("Could not rewrite file %s: %s", from, err.Error())
 		os.Stderr.Write([]byte("\n"))
@@ -150,6 +151,9 @@ func syncDir(dirFrom, dirTo string) {
 			}
 
 			if statsEqual(fi, toFi) {
+				if fi.Mode().IsRegular() {
+					recordUnchanged(fi, filepath.Join(dirFrom, name), filepath.Join(dirTo, name))
+				}
 				continue
 			}
 
@@ -167,8 +171,8 @@ func syncDir(dirFrom, dirTo string) {
 			continue
 		}
 
-		// don't remove original ("backup") files if the source file still exists
-		if _, ok := fromMap[strings.TrimSuffix(name, ".orig")]; ok {
+		// don't remove original ("backup") files and the cached reports if the source file still exists
+		if _, ok := fromMap[strings.TrimSuffix(strings.TrimSuffix(name, ".orig"), ".report")]; ok {
 			continue
 		}
 
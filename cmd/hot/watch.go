@@ -2,12 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/printer"
 	"go/token"
-	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -19,15 +19,13 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/kylelemons/godebug/diff"
-)
 
-func watchChanges(stdin io.WriteCloser) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatalf("watchChanges: fsnotify.NewWatcher(): %v", err)
-	}
+	hot "github.com/YuriyNasretdinov/hotreload"
+)
 
-	err = filepath.Walk(*watchDir, func(path string, info os.FileInfo, err error) error {
+// watchDirs adds the directory and all of it's subdirectories to the watcher.
+func watchDirs(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -38,27 +36,188 @@ func watchChanges(stdin io.WriteCloser) {
 
 		return nil
 	})
+}
 
+func watchChanges(a *app) {
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
+		log.Fatalf("watchChanges: fsnotify.NewWatcher(): %v", err)
+	}
+
+	if err := watchDirs(watcher, *watchDir); err != nil {
 		log.Fatalf("watchChanges: walk(%q): %v", *watchDir, err)
 	}
 
-	for ev := range watcher.Events {
-		if ev.Op == fsnotify.Chmod {
+	for {
+		var ev fsnotify.Event
+		select {
+		case ev = <-watcher.Events:
+		case p := <-a.failed:
+			// the application could have been restarted since
+			if p == a.current() {
+				log.Printf("The application exited after it was sent a plugin, restarting it")
+				a.restart()
+			}
 			continue
 		}
 
-		if ev.Op != fsnotify.Write {
-			log.Fatalf("Only WRITE changes are supported for live reload. Received %s event for %q", ev.Op, ev.Name)
+		if ev.Op == fsnotify.Chmod {
+			continue
 		}
 
+		// Editors that save files by writing to a temporary file and renaming it
+		// produce CREATE (or RENAME and then CREATE) events instead of WRITE,
+		// so all kinds of events are treated as a possible change of contents
+		// once the file settles down.
 		time.Sleep(time.Millisecond * 25)
 
-		handleEvent(ev, stdin)
+		switch classifyEvent(ev) {
+		case eventNewDir:
+			log.Printf("Watching new directory %q", ev.Name)
+			if err := watchDirs(watcher, ev.Name); err != nil {
+				log.Printf("Couldn't watch %q: %v", ev.Name, err)
+			}
+			continue
+		case eventDeleted:
+			log.Printf("%q was deleted, restart is required for the change to take effect", ev.Name)
+			delete(lastContents, ev.Name)
+			a.restart()
+			continue
+		case eventIgnored:
+			continue
+		}
+
+		if a.running() {
+			err = handleEvent(ev.Name, a)
+		} else {
+			// the command failed after the previous restart, the change may have fixed it
+			contents, rerr := ioutil.ReadFile(ev.Name)
+			if rerr == nil && bytes.Equal(lastContents[ev.Name], contents) {
+				continue
+			}
+			lastContents[ev.Name] = contents
+			err = fmt.Errorf("the application is not running")
+		}
+
+		err = checkCompiles(err, filepath.Dir(ev.Name))
+		if cerr, ok := err.(*compileError); ok {
+			log.Printf("%q does not compile, waiting for the next change:\n%s", ev.Name, strings.TrimSpace(cerr.msg))
+		} else if err != nil {
+			log.Printf("Couldn't apply changes in %q on-the-fly: %v", ev.Name, err)
+			a.restart()
+		}
+	}
+}
+
+// eventKind is what a file system event means for the application.
+type eventKind int
+
+const (
+	eventIgnored eventKind = iota
+	eventNewDir            // a directory was created and needs to be watched
+	eventDeleted           // a Go file was deleted, so the application needs to be restarted
+	eventChanged           // a Go file may have changed
+)
+
+// classifyEvent tells what the event means based on the current state of the file.
+func classifyEvent(ev fsnotify.Event) eventKind {
+	fi, err := os.Stat(ev.Name)
+	if os.IsNotExist(err) {
+		if strings.HasSuffix(ev.Name, ".go") {
+			return eventDeleted
+		}
+		return eventIgnored
+	} else if err != nil {
+		log.Printf("Couldn't stat %q: %v", ev.Name, err)
+		return eventIgnored
+	}
+
+	if fi.IsDir() {
+		if ev.Op&fsnotify.Create == fsnotify.Create {
+			return eventNewDir
+		}
+		return eventIgnored
+	}
+
+	if !strings.HasSuffix(ev.Name, ".go") {
+		return eventIgnored
+	}
+	return eventChanged
+}
+
+// checkCompiles turns the error of applying a change in the package in dir into
+// a *compileError if the package does not compile, because restarting is pointless then.
+func checkCompiles(err error, dir string) error {
+	if _, ok := err.(*compileError); err == nil || ok {
+		return err
+	}
+
+	if out, cerr := checkPackage(dir); cerr != nil {
+		return &compileError{msg: out}
+	}
+	return err
+}
+
+func allBlank(lines []string) bool {
+	for _, ln := range lines {
+		if strings.TrimSpace(ln) != "" {
+			return false
+		}
 	}
+	return true
+}
+
+// diffContext is how many unchanged lines are shown around every change by formatDiff.
+const diffContext = 3
+
+// formatDiff returns the changes between the contents of the file with "-" and "+"
+// in front of the deleted and added lines and a few unchanged lines around them.
+func formatDiff(oldContents, newContents []byte) string {
+	chunks := diff.DiffChunks(strings.Split(string(oldContents), "\n"),
+		strings.Split(string(newContents), "\n"))
+
+	var b strings.Builder
+	writeLines := func(prefix string, lines []string) {
+		for _, ln := range lines {
+			b.WriteString(prefix + ln + "\n")
+		}
+	}
+
+	for i, ch := range chunks {
+		writeLines("-", ch.Deleted)
+		writeLines("+", ch.Added)
+
+		eq := ch.Equal
+		first := i == 0 && len(ch.Added) == 0 && len(ch.Deleted) == 0
+		last := i == len(chunks)-1
+
+		switch {
+		case first && last:
+		case first:
+			if len(eq) > diffContext {
+				b.WriteString("...\n")
+				eq = eq[len(eq)-diffContext:]
+			}
+			writeLines(" ", eq)
+		case last:
+			if len(eq) > diffContext {
+				eq = eq[:diffContext]
+			}
+			writeLines(" ", eq)
+		case len(eq) > 2*diffContext:
+			writeLines(" ", eq[:diffContext])
+			b.WriteString("...\n")
+			writeLines(" ", eq[len(eq)-diffContext:])
+		default:
+			writeLines(" ", eq)
+		}
+	}
+
+	return b.String()
 }
 
 // computeChangedLines calculates which lines in the new file have changed and/or deleted.
+// Blank lines that were added or deleted are not considered to be changes.
 func computeChangedLines(oldContents, newContents []byte) map[int]bool {
 	chunks := diff.DiffChunks(strings.Split(string(oldContents), "\n"),
 		strings.Split(string(newContents), "\n"))
@@ -67,13 +226,15 @@ func computeChangedLines(oldContents, newContents []byte) map[int]bool {
 	curNewLn := 1
 
 	for _, ch := range chunks {
-		if len(ch.Deleted) > 0 {
+		if len(ch.Deleted) > 0 && !allBlank(ch.Deleted) {
 			changedLines[curNewLn] = true
 		}
 
 		if len(ch.Added) > 0 {
-			for i := 0; i < len(ch.Added); i++ {
-				changedLines[curNewLn+i] = true
+			for i, ln := range ch.Added {
+				if strings.TrimSpace(ln) != "" {
+					changedLines[curNewLn+i] = true
+				}
 			}
 			curNewLn += len(ch.Added)
 		}
@@ -84,8 +245,26 @@ func computeChangedLines(oldContents, newContents []byte) map[int]bool {
 	return changedLines
 }
 
-func getChangedDecls(fset *token.FileSet, f *ast.File, changedLines map[int]bool) ([]*ast.FuncDecl, error) {
-	var changedDecls []*ast.FuncDecl
+// getFuncDeclNames returns names (as returned by getFuncDeclName) of all the functions
+// and methods declared in the file.
+func getFuncDeclNames(filename string, contents []byte) (map[string]bool, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, contents, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, d := range f.Decls {
+		if d, ok := d.(*ast.FuncDecl); ok {
+			names[getFuncDeclName(d, f.Name.Name)] = true
+		}
+	}
+	return names, nil
+}
+
+// getChangedDecls returns the functions that were changed and the functions that
+// were added compared to the original file which declared origFuncs.
+func getChangedDecls(fset *token.FileSet, f *ast.File, changedLines map[int]bool, origFuncs map[string]bool) (changedDecls, newDecls []*ast.FuncDecl, err error) {
 	changedLinesLeft := make(map[int]bool)
 	for k, v := range changedLines {
 		changedLinesLeft[k] = v
@@ -97,6 +276,11 @@ func getChangedDecls(fset *token.FileSet, f *ast.File, changedLines map[int]bool
 			startLn := fset.Position(d.Pos()).Line
 			endLn := fset.Position(d.End()).Line
 
+			// doc comments are a part of the function too
+			if d.Doc != nil {
+				startLn = fset.Position(d.Doc.Pos()).Line
+			}
+
 			changed := false
 
 			for i := startLn; i <= endLn; i++ {
@@ -106,8 +290,16 @@ func getChangedDecls(fset *token.FileSet, f *ast.File, changedLines map[int]bool
 				}
 			}
 
-			if changed {
-				changedDecls = append(changedDecls, d)
+			if origFuncs[getFuncDeclName(d, f.Name.Name)] {
+				if changed && isGeneric(d) {
+					return nil, nil, fmt.Errorf("Changing generic functions is not supported: %s", getFuncDeclName(d, f.Name.Name))
+				} else if changed {
+					changedDecls = append(changedDecls, d)
+				}
+			} else if d.Recv != nil {
+				return nil, nil, fmt.Errorf("Adding new methods is not supported: %s", getFuncDeclName(d, f.Name.Name))
+			} else {
+				newDecls = append(newDecls, d)
 			}
 		case *ast.GenDecl:
 			// allow changes in imports
@@ -125,47 +317,87 @@ func getChangedDecls(fset *token.FileSet, f *ast.File, changedLines map[int]bool
 	}
 
 	if len(changedLinesLeft) > 0 {
-		return nil, fmt.Errorf("Changed some lines that do not belong to the function implementations: %+v", changedLinesLeft)
+		return nil, nil, fmt.Errorf("Changed some lines that do not belong to the function implementations: %+v", changedLinesLeft)
 	}
 
-	return changedDecls, nil
+	return changedDecls, newDecls, nil
 }
 
+// getFuncDeclName returns the name of the function as it is registered, without the package path.
+// Methods of generic types are named after the type without the type parameters, e.g. "*List.Push".
 func getFuncDeclName(d *ast.FuncDecl, origPkgName string) string {
-	var name string
+	if d.Recv == nil {
+		return d.Name.Name
+	}
 
-	if d.Recv != nil {
-		switch r := d.Recv.List[0].Type.(type) {
-		case *ast.StarExpr:
-			name = "*" + r.X.(*ast.Ident).Name + "." + d.Name.Name
-		case *ast.Ident:
-			name = r.Name + "." + d.Name.Name
+	var prefix string
+	typ := d.Recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ, prefix = star.X, "*"
+	}
+
+	switch t := typ.(type) {
+	case *ast.IndexExpr:
+		typ = t.X
+	case *ast.IndexListExpr:
+		typ = t.X
+	}
+
+	var typeName string
+	if id, ok := typ.(*ast.Ident); ok {
+		typeName = id.Name
+	}
+
+	return prefix + typeName + "." + d.Name.Name
+}
+
+// pluginFuncNames returns the names that the changed functions and methods get in the plugin.
+// New functions keep their names because the other code refers to them, so they must not
+// take the reserved names that the plugin needs itself. Methods of different types can have
+// the same name, so they are named after the type, and a number is added to the names that
+// are still taken.
+func pluginFuncNames(decls, newDecls []*ast.FuncDecl, reserved ...string) (map[*ast.FuncDecl]string, error) {
+	taken := make(map[string]bool)
+	for _, name := range reserved {
+		taken[name] = true
+	}
+
+	for _, d := range newDecls {
+		if taken[d.Name.Name] {
+			return nil, fmt.Errorf("New function %s clashes with a name that the plugin needs", d.Name.Name)
 		}
-	} else {
-		name = d.Name.Name
+		taken[d.Name.Name] = true
 	}
 
-	return name
+	names := make(map[*ast.FuncDecl]string, len(decls))
+	for _, d := range decls {
+		base := d.Name.Name
+		if d.Recv != nil {
+			typeName, _, _ := recvTypeName(d)
+			base = typeName + "_" + base
+		}
+
+		name := base
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("%s%d", base, i)
+		}
+		taken[name] = true
+		names[d] = name
+	}
+	return names, nil
 }
 
-func rewriteFuncDecl(d *ast.FuncDecl, origPkgName string) *ast.FuncDecl {
+// rewriteFuncDecl turns a method into a function that accepts the receiver as the first argument.
+// The types are expected to be already qualified with the name pkgName of the original package.
+func rewriteFuncDecl(d *ast.FuncDecl, pkgName string) *ast.FuncDecl {
+	// arguments of a function must be either all named or all unnamed
+	nameParams(d)
+	// arguments must not shadow the original package the qualified types refer to
+	renameClashingParams(d, pkgName)
+
 	if d.Recv != nil {
 		var l []*ast.Field
-		rcv := d.Recv.List[0]
-		switch r := rcv.Type.(type) {
-		case *ast.StarExpr:
-			rcv.Type = &ast.StarExpr{X: &ast.SelectorExpr{
-				X:   ast.NewIdent(origPkgName),
-				Sel: r.X.(*ast.Ident),
-			}}
-		case *ast.Ident:
-			rcv.Type = &ast.SelectorExpr{
-				X:   ast.NewIdent(origPkgName),
-				Sel: r,
-			}
-		}
-
-		l = append(l, rcv)
+		l = append(l, d.Recv.List[0])
 		l = append(l, d.Type.Params.List...)
 		d.Type.Params.List = l
 		d.Recv = nil
@@ -174,27 +406,48 @@ func rewriteFuncDecl(d *ast.FuncDecl, origPkgName string) *ast.FuncDecl {
 	return d
 }
 
-func compileNewFile(pkgPath, filename string, contents []byte, changedLines map[int]bool) (string, error) {
+func compileNewFile(pkgPath, filename string, contents []byte, changedLines map[int]bool, origFuncs map[string]bool) (string, error) {
 	fset := token.NewFileSet() // positions are relative to fset
 
-	f, err := parser.ParseFile(fset, filename, contents, 0)
+	f, err := parser.ParseFile(fset, filename, contents, parser.ParseComments)
 	if err != nil {
-		return "", err
+		return "", &compileError{msg: err.Error()}
 	}
 
 	origPkgName := f.Name.Name // name of the package originally (not to be confused with it's path)
 
-	decls, err := getChangedDecls(fset, f, changedLines)
+	decls, newDecls, err := getChangedDecls(fset, f, changedLines, origFuncs)
 	if err != nil {
 		return "", err
 	}
 
+	// comments were only needed to find out which function they belong to
+	// and would end up in random places in the plugin code
+	f.Comments = nil
+
+	info, err := parsePkgInfo(filepath.Dir(filename), origPkgName)
+	if err != nil {
+		return "", err
+	}
+
+	local := make(map[string]bool)
+	for _, d := range newDecls {
+		local[d.Name.Name] = true
+	}
+
+	q := newQualifier(info, origPkgName, f, local)
+
 	var mockBody []ast.Stmt
 	var imports []ast.Decl
 	var haveHot bool
 
 	for idx, d := range f.Decls {
 		if d, ok := d.(*ast.FuncDecl); ok {
+			// new and generic functions are not registered, so there is nothing to reset
+			if !origFuncs[getFuncDeclName(d, origPkgName)] || isGeneric(d) {
+				continue
+			}
+
 			// hot.ResetByName(package)
 			mockBody = append(mockBody, &ast.ExprStmt{
 				X: &ast.CallExpr{
@@ -250,9 +503,16 @@ func compileNewFile(pkgPath, filename string, contents []byte, changedLines map[
 	f.Decls = nil
 	f.Decls = append(f.Decls, imports...)
 
+	funcNames, err := pluginFuncNames(decls, newDecls, "Mock", "main", "hot", origPkgName)
+	if err != nil {
+		return "", err
+	}
+
 	for _, d := range decls {
 		name := getFuncDeclName(d, origPkgName)
+		q.qualifyFuncDecl(d)
 		fun := rewriteFuncDecl(d, origPkgName)
+		fun.Name = ast.NewIdent(funcNames[d])
 		f.Decls = append(f.Decls, fun)
 
 		// hot.MockByName(package, function)
@@ -273,6 +533,14 @@ func compileNewFile(pkgPath, filename string, contents []byte, changedLines map[
 		})
 	}
 
+	// new functions are not registered in the application and can only be
+	// called from the code in the plugin, so they are included as is
+	for _, d := range newDecls {
+		q.qualifyFuncDecl(d)
+		renameClashingParams(d, origPkgName)
+		f.Decls = append(f.Decls, d)
+	}
+
 	mockBody = append(mockBody, &ast.ExprStmt{
 		X: &ast.CallExpr{
 			Fun: ast.NewIdent("println"),
@@ -304,16 +572,18 @@ func compileNewFile(pkgPath, filename string, contents []byte, changedLines map[
 		Body: &ast.BlockStmt{},
 	})
 
-	pr := (&printer.Config{Tabwidth: 4})
+	// positions are preserved using //line comments so that compilation
+	// errors refer to the original file
+	pr := (&printer.Config{Tabwidth: 4, Mode: printer.SourcePos})
 
 	var b bytes.Buffer
 	if err := pr.Fprint(&b, fset, f); err != nil {
 		return "", err
 	}
 
-	liveDir := softGopath + "/src/live"
-	liveFile := liveDir + "/main.go"
-	plugPath := liveDir + "/plug" + fmt.Sprint(time.Now().UnixNano()+rand.Int63()) + ".so"
+	liveDir := ws.liveDir()
+	liveFile := filepath.Join(liveDir, "main.go")
+	plugPath := filepath.Join(liveDir, "plug"+fmt.Sprint(time.Now().UnixNano()+rand.Int63())+".so")
 
 	os.RemoveAll(liveDir)
 	if err := os.MkdirAll(liveDir, 0777); err != nil {
@@ -332,9 +602,30 @@ func compileNewFile(pkgPath, filename string, contents []byte, changedLines map[
 	log.Printf("goimports finished in %s", time.Since(start))
 
 	start = time.Now()
-	gobuild := exec.Command("go", "build", "-buildmode=plugin", "-o", plugPath, liveFile)
-	gobuild.Stderr = os.Stderr
+	args := []string{"build", "-buildmode=plugin", "-o", plugPath}
+	buildFile := liveFile
+	if ws.overlay {
+		var overlay string
+		buildFile, overlay, err = ws.liveOverlay(liveFile, plugPath)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-overlay="+overlay)
+	}
+
+	gobuild := exec.Command("go", append(args, buildFile)...)
+	gobuild.Dir = ws.buildDir()
+	var buildOut bytes.Buffer
+	gobuild.Stderr = &buildOut
 	if err := gobuild.Run(); err != nil {
+		// the plugin may fail to compile either because the code is broken or because
+		// it uses something that can't be used from a plugin, and the latter is only
+		// fixed by a restart
+		if out, err := checkPackage(filepath.Dir(filename)); err != nil {
+			return "", &compileError{msg: out}
+		}
+
+		os.Stderr.Write(buildOut.Bytes())
 		return "", fmt.Errorf("Go build for plugin for %q failed: %v", liveFile, err)
 	}
 	log.Printf("go build -buildmode=plugin finished in %s", time.Since(start))
@@ -349,27 +640,81 @@ func compileNewFile(pkgPath, filename string, contents []byte, changedLines map[
 	return plugPath, nil
 }
 
-func handleEvent(ev fsnotify.Event, stdin io.WriteCloser) {
-	goPkg := strings.TrimPrefix(ev.Name, gopath+"/src/")
-	origPath := softGopath + "/src/" + goPkg + ".orig"
+// compileError means that the changed code itself does not compile, so there is nothing
+// to reload or restart until the next change fixes it.
+type compileError struct {
+	msg string
+}
+
+func (e *compileError) Error() string {
+	return e.msg
+}
 
-	newContents, err := ioutil.ReadFile(ev.Name)
+// checkPackage compiles the package in the original source directory dir
+// and returns the compiler output if it fails.
+func checkPackage(dir string) (string, error) {
+	cmd := exec.Command("go", "build", "-o", os.DevNull, ".")
+	cmd.Dir = dir
+	cmd.Env = origEnv
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// lastContents holds the contents of the files at the moment of the last change
+// so that multiple events for a single change are only handled once.
+var lastContents = make(map[string][]byte)
+
+// handleEvent compiles the changes in the file into a plugin and makes the application load it.
+// An error means that the change can't be applied on-the-fly.
+func handleEvent(filename string, a *app) error {
+	pkgPath, err := ws.importPath(filepath.Dir(filename))
 	if err != nil {
-		log.Fatalf("Couldn't read %q: %v", ev.Name, err)
+		return fmt.Errorf("couldn't determine package: %v", err)
 	}
 
-	origContents, err := ioutil.ReadFile(origPath)
+	softPath, err := ws.softPath(filename)
 	if err != nil {
-		log.Fatalf("Couldn't read %q: %v", origPath, err)
+		return fmt.Errorf("couldn't determine instrumented copy: %v", err)
+	}
+	origPath := softPath + ".orig"
+
+	newContents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if last, ok := lastContents[filename]; ok && bytes.Equal(last, newContents) {
+		return nil
+	}
+	lastContents[filename] = newContents
+
+	origContents, err := ioutil.ReadFile(origPath)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(softPath + ".hash"); err == nil {
+			return fmt.Errorf("it was not instrumented")
+		}
+		return fmt.Errorf("it is a new file")
+	} else if err != nil {
+		return err
 	}
 
 	changedLines := computeChangedLines(origContents, newContents)
 
-	plugPath, err := compileNewFile(filepath.Dir(goPkg), ev.Name, newContents, changedLines)
+	origFuncs, err := getFuncDeclNames(origPath, origContents)
 	if err != nil {
-		log.Fatalf("Compilation of %q failed: %v", ev.Name, err)
+		return fmt.Errorf("couldn't parse %q: %v", origPath, err)
+	}
+
+	plugPath, err := compileNewFile(pkgPath, filename, newContents, changedLines, origFuncs)
+	if err != nil {
+		return err
 	}
 
 	log.Printf("Compiled new plugin: %s", plugPath)
-	fmt.Fprintf(stdin, "%s\n", plugPath)
+	return a.reload(hot.ReloadRequest{
+		Plugin: plugPath,
+		Source: filename,
+		Hash:   fmt.Sprintf("%x", sha256.Sum256(newContents)),
+		Diff:   formatDiff(origContents, newContents),
+	})
 }
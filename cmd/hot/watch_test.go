@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestClassifyEvent(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.go":     "package p\n",
+		"a.txt":    "",
+		"new/b.go": "package p\n",
+	})
+
+	tests := []struct {
+		name string
+		op   fsnotify.Op
+		want eventKind
+	}{
+		{"a.go", fsnotify.Write, eventChanged},
+		{"a.go", fsnotify.Create, eventChanged},
+		{"a.go", fsnotify.Rename, eventChanged},
+		{"a.txt", fsnotify.Write, eventIgnored},
+		{"new", fsnotify.Create, eventNewDir},
+		{"new", fsnotify.Write, eventIgnored},
+		{"deleted.go", fsnotify.Remove, eventDeleted},
+		{"deleted.go", fsnotify.Rename, eventDeleted},
+		{"deleted.txt", fsnotify.Remove, eventIgnored},
+	}
+
+	for _, tt := range tests {
+		ev := fsnotify.Event{Name: filepath.Join(dir, tt.name), Op: tt.op}
+		if got := classifyEvent(ev); got != tt.want {
+			t.Errorf("classifyEvent(%s %s) = %v, want %v", tt.op, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCompiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"ok/go.mod":     "module example.com/ok\n\ngo 1.16\n",
+		"ok/a.go":       "package ok\n\nfunc F() int { return 1 }\n",
+		"broken/go.mod": "module example.com/broken\n\ngo 1.16\n",
+		"broken/a.go":   "package broken\n\nvar x int = \"x\"\n",
+	})
+
+	okDir, brokenDir := filepath.Join(dir, "ok"), filepath.Join(dir, "broken")
+	applyErr := errors.New("can't apply")
+	compileErr := &compileError{msg: "a.go:1: syntax error"}
+
+	if err := checkCompiles(nil, brokenDir); err != nil {
+		t.Errorf("applied change: got %v, want nil", err)
+	}
+
+	if err := checkCompiles(compileErr, okDir); err != compileErr {
+		t.Errorf("compile error: got %v, want %v", err, compileErr)
+	}
+
+	if err := checkCompiles(applyErr, okDir); err != applyErr {
+		t.Errorf("package that compiles: got %v, want %v", err, applyErr)
+	}
+
+	err := checkCompiles(applyErr, brokenDir)
+	if cerr, ok := err.(*compileError); !ok || !strings.Contains(cerr.msg, "a.go:3") {
+		t.Errorf("package that does not compile: got %#v, want a compile error for a.go:3", err)
+	}
+}
+
+func TestComputeChangedLines(t *testing.T) {
+	const orig = "package p\n\nfunc a() {\n\treturn\n}\n\nfunc b() {}\n"
+
+	tests := []struct {
+		name     string
+		contents string
+		want     map[int]bool
+	}{
+		{"same", orig, map[int]bool{}},
+		{"changed line", "package p\n\nfunc a() {\n\tprintln()\n}\n\nfunc b() {}\n", map[int]bool{4: true}},
+		{"added line", "package p\n\nfunc a() {\n\tprintln()\n\treturn\n}\n\nfunc b() {}\n", map[int]bool{4: true}},
+		{"deleted line", "package p\n\nfunc a() {\n}\n\nfunc b() {}\n", map[int]bool{4: true}},
+		{"added blank lines", "package p\n\n\nfunc a() {\n\treturn\n}\n\n\nfunc b() {}\n", map[int]bool{}},
+		{"deleted blank line", "package p\nfunc a() {\n\treturn\n}\n\nfunc b() {}\n", map[int]bool{}},
+		{"new function", orig + "\nfunc c() {}\n", map[int]bool{9: true}},
+	}
+
+	for _, tt := range tests {
+		if got := computeChangedLines([]byte(orig), []byte(tt.contents)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got changed lines %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetChangedDecls(t *testing.T) {
+	const orig = `package p
+
+import "fmt"
+
+var x = 1
+
+// a does nothing
+func a() {}
+
+func (t *T) m() {}
+
+func g[V any](v V) {}
+`
+
+	tests := []struct {
+		name        string
+		contents    string
+		wantChanged []string
+		wantNew     []string
+		wantErr     string
+	}{
+		{
+			name:     "unchanged",
+			contents: orig,
+		},
+		{
+			name:        "changed function",
+			contents:    strings.Replace(orig, "func a() {}", "func a() { fmt.Println() }", 1),
+			wantChanged: []string{"a"},
+		},
+		{
+			name:        "changed doc comment",
+			contents:    strings.Replace(orig, "does nothing", "does almost nothing", 1),
+			wantChanged: []string{"a"},
+		},
+		{
+			name:        "changed method",
+			contents:    strings.Replace(orig, "func (t *T) m() {}", "func (t *T) m() { a() }", 1),
+			wantChanged: []string{"*T.m"},
+		},
+		{
+			name:     "changed imports",
+			contents: strings.Replace(orig, `import "fmt"`, "import (\n\t\"fmt\"\n\t\"os\"\n)", 1),
+		},
+		{
+			name:     "new function",
+			contents: orig + "\nfunc b() { a() }\n",
+			wantNew:  []string{"b"},
+		},
+		{
+			name:     "new method",
+			contents: orig + "\nfunc (t *T) n() {}\n",
+			wantErr:  "Adding new methods is not supported: *T.n",
+		},
+		{
+			name:     "changed generic function",
+			contents: strings.Replace(orig, "func g[V any](v V) {}", "func g[V any](v V) { a() }", 1),
+			wantErr:  "Changing generic functions is not supported: g",
+		},
+		{
+			name:     "changed variable",
+			contents: strings.Replace(orig, "var x = 1", "var x = 2", 1),
+			wantErr:  "Changed some lines that do not belong to the function implementations",
+		},
+	}
+
+	origFuncs, err := getFuncDeclNames("a.go", []byte(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(decls []*ast.FuncDecl) []string {
+		var res []string
+		for _, d := range decls {
+			res = append(res, getFuncDeclName(d, "p"))
+		}
+		return res
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, "a.go", tt.contents, parser.ParseComments)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			changedLines := computeChangedLines([]byte(orig), []byte(tt.contents))
+			changed, added, err := getChangedDecls(fset, f, changedLines, origFuncs)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := names(changed); !reflect.DeepEqual(got, tt.wantChanged) {
+				t.Errorf("changed = %v, want %v", got, tt.wantChanged)
+			}
+			if got := names(added); !reflect.DeepEqual(got, tt.wantNew) {
+				t.Errorf("new = %v, want %v", got, tt.wantNew)
+			}
+		})
+	}
+}
+
+func TestGetFuncDeclName(t *testing.T) {
+	const src = `package p
+
+func f() {}
+func (T) value() {}
+func (t *T) pointer() {}
+func (l List[T]) generic() {}
+func (m *Map[K, V]) generic2() {}
+`
+
+	f, err := parser.ParseFile(token.NewFileSet(), "a.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"f", "T.value", "*T.pointer", "List.generic", "*Map.generic2"}
+	var got []string
+	for _, d := range f.Decls {
+		got = append(got, getFuncDeclName(d.(*ast.FuncDecl), "p"))
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPluginFuncNames(t *testing.T) {
+	const src = `package p
+
+func F() {}
+func (T) m() {}
+func (*U) m() {}
+func (a_b) c() {}
+func (a) b_c() {}
+func T_m() {}
+`
+
+	f, err := parser.ParseFile(token.NewFileSet(), "a.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decls []*ast.FuncDecl
+	for _, d := range f.Decls {
+		decls = append(decls, d.(*ast.FuncDecl))
+	}
+
+	newDecl := func(name string) *ast.FuncDecl {
+		return &ast.FuncDecl{Name: ast.NewIdent(name), Type: &ast.FuncType{Params: &ast.FieldList{}}}
+	}
+
+	names, err := pluginFuncNames(decls, []*ast.FuncDecl{newDecl("U_m")}, "Mock", "main", "hot", "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"F", "T_m", "U_m2", "a_b_c", "a_b_c2", "T_m2"}
+	var got []string
+	for _, d := range decls {
+		got = append(got, names[d])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, name := range []string{"Mock", "main", "p"} {
+		if _, err := pluginFuncNames(decls, []*ast.FuncDecl{newDecl(name)}, "Mock", "main", "hot", "p"); err == nil {
+			t.Errorf("new function %s must not be allowed", name)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hotPkgPath is the import path of the package that instrumented code registers itself in.
+const hotPkgPath = "github.com/YuriyNasretdinov/hotreload"
+
+// tree is a directory with Go sources that is mirrored into dst with all functions instrumented.
+type tree struct {
+	src        string // directory with the original sources
+	dst        string // directory with the instrumented copy
+	importPath string // import path of the package in src, empty for $GOPATH/src and vendor dirs
+}
+
+// workspace describes all the source trees that are instrumented and the import paths
+// of packages inside them.
+// In GOPATH mode there is a single tree for $GOPATH/src and import paths are derived
+// from the directory layout. In module mode there is a tree for the main module,
+// one for it's vendor dir (if any) and one for each replace directive that points to a local directory.
+type workspace struct {
+	trees   []tree
+	modDir  string // root of the main module, empty in GOPATH mode
+	overlay bool   // instrumented files are passed to the toolchain via -overlay instead of mirroring the trees
+
+	// files from the trees that are replaced by the instrumented copies in overlay mode
+	overlayFiles map[string]string
+
+	// replace directives with absolute paths that need to point to the instrumented copies
+	absReplaces map[string]string
+}
+
+// modFile is the subset of `go mod edit -json` output that we are interested in.
+type modFile struct {
+	Module struct {
+		Path string
+	}
+	Replace []struct {
+		Old struct {
+			Path string
+		}
+		New struct {
+			Path    string
+			Version string
+		}
+	}
+}
+
+// goEnv returns the value of the go environment variable as seen by the go tool run in dir.
+func goEnv(dir, name string) (string, error) {
+	cmd := exec.Command("go", "env", name)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go env %s: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// detectWorkspace finds the module that contains dir and builds the list of trees to instrument.
+// If dir is not in a module then the GOPATH layout is used.
+func detectWorkspace(dir string, overlay bool) (*workspace, error) {
+	gomod, err := goEnv(dir, "GOMOD")
+	if err != nil {
+		return nil, err
+	}
+
+	if gomod == "" || gomod == os.DevNull {
+		if gopath == "" {
+			return nil, fmt.Errorf("%q is not inside a module and GOPATH is not set", dir)
+		}
+
+		ws := &workspace{overlay: overlay}
+		if overlay {
+			ws.addTree(filepath.Join(gopath, "src"), "")
+		} else {
+			ws.trees = []tree{{
+				src: filepath.Join(gopath, "src"),
+				dst: filepath.Join(softGopath, "src"),
+			}}
+		}
+		return ws, nil
+	}
+
+	cmd := exec.Command("go", "mod", "edit", "-json", gomod)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go mod edit -json %s: %v", gomod, err)
+	}
+
+	var mf modFile
+	if err := json.NewDecoder(bytes.NewReader(out)).Decode(&mf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", gomod, err)
+	}
+
+	modDir := filepath.Dir(gomod)
+	ws := &workspace{modDir: modDir, overlay: overlay}
+	ws.addTree(modDir, mf.Module.Path)
+
+	if fi, err := os.Stat(filepath.Join(modDir, "vendor", "modules.txt")); err == nil && fi.Mode().IsRegular() {
+		ws.addTree(filepath.Join(modDir, "vendor"), "")
+	}
+
+	for _, r := range mf.Replace {
+		// replacements with a version refer to other modules and not to a local directory
+		if r.New.Version != "" {
+			continue
+		}
+
+		dir := r.New.Path
+		if filepath.IsAbs(dir) {
+			if ws.absReplaces == nil {
+				ws.absReplaces = make(map[string]string)
+			}
+			ws.absReplaces[r.Old.Path] = dir
+		} else {
+			dir = filepath.Join(modDir, dir)
+		}
+		ws.addTree(dir, r.Old.Path)
+	}
+
+	return ws, nil
+}
+
+// addTree adds a tree for the directory src. The instrumented copy keeps the
+// absolute path of the original so that relative replace directives in go.mod
+// still point to the (instrumented) copies.
+// In overlay mode only the instrumented Go files and the originals for them are stored there.
+func (w *workspace) addTree(src, importPath string) {
+	dstRoot := filepath.Join(softDir, "m")
+	if w.overlay {
+		dstRoot = filepath.Join(softDir, "o")
+	}
+
+	w.trees = append(w.trees, tree{
+		src:        src,
+		dst:        filepath.Join(dstRoot, src),
+		importPath: importPath,
+	})
+}
+
+// sync mirrors all the trees into their instrumented copies or, in overlay mode,
+// rewrites the Go files in them and writes the overlay file.
+func (w *workspace) sync() error {
+	// the files may have been deleted since the last sync
+	fileResults = make(map[string]fileResult)
+
+	if w.overlay {
+		return w.writeOverlay()
+	}
+
+	for _, t := range w.outerTrees() {
+		syncDir(t.src, t.dst)
+	}
+
+	return w.fixReplaces()
+}
+
+// outerTrees returns trees that are not nested inside other trees (e.g. vendor dir)
+// so that nested ones are processed only once as part of the outer tree.
+func (w *workspace) outerTrees() []tree {
+	var res []tree
+	for _, t := range w.trees {
+		if outer, _, ok := w.find(filepath.Dir(t.src)); ok && outer.src != t.src {
+			continue
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// fixReplaces points replace directives with absolute paths in the go.mod of
+// the instrumented main module to the instrumented copies of the replacements.
+func (w *workspace) fixReplaces() error {
+	if len(w.absReplaces) == 0 {
+		return nil
+	}
+
+	args := []string{"mod", "edit"}
+	for old, dir := range w.absReplaces {
+		dst, err := w.softPath(dir)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-replace="+old+"="+dst)
+	}
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = w.buildDir()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go mod edit in %s: %v", cmd.Dir, err)
+	}
+	return nil
+}
+
+// find returns the tree with the longest src prefix that contains the path and
+// the path relative to it.
+func (w *workspace) find(path string) (t tree, rel string, ok bool) {
+	for _, cur := range w.trees {
+		if len(cur.src) < len(t.src) {
+			continue
+		}
+
+		r, err := filepath.Rel(cur.src, path)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(os.PathSeparator)) {
+			continue
+		}
+
+		t, rel, ok = cur, r, true
+	}
+	return t, rel, ok
+}
+
+// importPath returns the import path of the package in the directory dir.
+func (w *workspace) importPath(dir string) (string, error) {
+	t, rel, ok := w.find(dir)
+	if !ok {
+		return "", fmt.Errorf("%q is outside of the instrumented source trees", dir)
+	}
+
+	if rel == "." {
+		rel = ""
+	}
+
+	return strings.Trim(t.importPath+"/"+filepath.ToSlash(rel), "/"), nil
+}
+
+// softPath returns the path of the instrumented copy of the file or directory.
+func (w *workspace) softPath(path string) (string, error) {
+	t, rel, ok := w.find(path)
+	if !ok {
+		return "", fmt.Errorf("%q is outside of the instrumented source trees", path)
+	}
+	return filepath.Join(t.dst, rel), nil
+}
+
+// buildDir is the directory in which plugins need to be built so that they use
+// the same dependencies as the application.
+func (w *workspace) buildDir() string {
+	switch {
+	case w.overlay && w.modDir == "":
+		return filepath.Join(gopath, "src")
+	case w.overlay:
+		return w.modDir
+	case w.modDir == "":
+		return filepath.Join(softGopath, "src")
+	}
+
+	dir, _ := w.softPath(w.modDir)
+	return dir
+}
+
+// liveDir is the directory where the sources for plugins are generated.
+// In module mode it must reside inside the main module, and the leading
+// underscore makes sure that it is not matched by "./..." patterns.
+// In overlay mode the sources are written into the cache dir instead
+// and are mapped into the buildDir using the overlay.
+func (w *workspace) liveDir() string {
+	if w.overlay {
+		return filepath.Join(softDir, "o", "_hotlive")
+	}
+
+	return w.buildLiveDir()
+}
+
+// buildLiveDir is the directory where the toolchain expects to find plugin sources.
+func (w *workspace) buildLiveDir() string {
+	if w.modDir == "" {
+		return filepath.Join(w.buildDir(), "live")
+	}
+
+	return filepath.Join(w.buildDir(), "_hotlive")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// setTestDirs points GOPATH and the directories for instrumented copies to temporary dirs.
+func setTestDirs(t *testing.T) {
+	oldGopath, oldSoftDir, oldSoftGopath := gopath, softDir, softGopath
+	t.Cleanup(func() {
+		gopath, softDir, softGopath = oldGopath, oldSoftDir, oldSoftGopath
+	})
+
+	gopath = t.TempDir()
+	softDir = filepath.Join(t.TempDir(), "soft")
+	softGopath = filepath.Join(softDir, "p")
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDetectWorkspaceModule(t *testing.T) {
+	setTestDirs(t)
+
+	root := t.TempDir()
+	mainDir := filepath.Join(root, "app")
+	absDir := filepath.Join(t.TempDir(), "abs")
+
+	writeFiles(t, root, map[string]string{
+		"app/go.mod": `module example.com/app
+
+go 1.16
+
+require (
+	example.com/rel v0.0.0
+	example.com/lib v0.0.0
+	example.com/abs v0.0.0
+	example.com/ver v1.0.0
+	github.com/vendored/pkg v1.0.0
+)
+
+replace example.com/rel => ../rel
+
+replace example.com/lib => ./lib
+
+replace example.com/abs => ` + absDir + `
+
+replace example.com/ver => example.com/other v1.0.0
+`,
+		"app/vendor/modules.txt": "# github.com/vendored/pkg v1.0.0\n",
+		"rel/go.mod":             "module example.com/rel\n",
+		"app/lib/go.mod":         "module example.com/lib\n",
+		"app/cmd/main.go":        "package main\n",
+	})
+	writeFiles(t, absDir, map[string]string{"go.mod": "module example.com/abs\n"})
+
+	w, err := detectWorkspace(filepath.Join(mainDir, "cmd"), false)
+	if err != nil {
+		t.Fatalf("detectWorkspace: %v", err)
+	}
+
+	if w.modDir != mainDir {
+		t.Errorf("modDir = %q, want %q", w.modDir, mainDir)
+	}
+
+	soft := filepath.Join(softDir, "m")
+	wantTrees := []tree{
+		{src: mainDir, dst: filepath.Join(soft, mainDir), importPath: "example.com/app"},
+		{src: filepath.Join(mainDir, "vendor"), dst: filepath.Join(soft, mainDir, "vendor")},
+		{src: filepath.Join(root, "rel"), dst: filepath.Join(soft, root, "rel"), importPath: "example.com/rel"},
+		{src: filepath.Join(mainDir, "lib"), dst: filepath.Join(soft, mainDir, "lib"), importPath: "example.com/lib"},
+		{src: absDir, dst: filepath.Join(soft, absDir), importPath: "example.com/abs"},
+	}
+	if !reflect.DeepEqual(w.trees, wantTrees) {
+		t.Errorf("trees = %+v, want %+v", w.trees, wantTrees)
+	}
+
+	wantAbs := map[string]string{"example.com/abs": absDir}
+	if !reflect.DeepEqual(w.absReplaces, wantAbs) {
+		t.Errorf("absReplaces = %v, want %v", w.absReplaces, wantAbs)
+	}
+
+	// vendor and ./lib are inside the main module
+	wantOuter := []tree{wantTrees[0], wantTrees[2], wantTrees[4]}
+	if outer := w.outerTrees(); !reflect.DeepEqual(outer, wantOuter) {
+		t.Errorf("outerTrees() = %+v, want %+v", outer, wantOuter)
+	}
+
+	importPaths := []struct {
+		dir  string
+		want string
+	}{
+		{mainDir, "example.com/app"},
+		{filepath.Join(mainDir, "pkg", "sub"), "example.com/app/pkg/sub"},
+		{filepath.Join(mainDir, "vendor", "github.com", "vendored", "pkg"), "github.com/vendored/pkg"},
+		{filepath.Join(mainDir, "lib", "x"), "example.com/lib/x"},
+		{filepath.Join(root, "rel", "sub"), "example.com/rel/sub"},
+		{absDir, "example.com/abs"},
+	}
+	for _, tt := range importPaths {
+		if got, err := w.importPath(tt.dir); err != nil || got != tt.want {
+			t.Errorf("importPath(%q) = %q, %v, want %q", tt.dir, got, err, tt.want)
+		}
+	}
+
+	for _, dir := range []string{root, filepath.Join(root, "relative"), filepath.Join(root, "other", "app")} {
+		if got, err := w.importPath(dir); err == nil {
+			t.Errorf("importPath(%q) = %q, want an error", dir, got)
+		}
+	}
+
+	path := filepath.Join(mainDir, "vendor", "github.com", "vendored", "pkg", "a.go")
+	if got, err := w.softPath(path); err != nil || got != filepath.Join(soft, path) {
+		t.Errorf("softPath(%q) = %q, %v, want %q", path, got, err, filepath.Join(soft, path))
+	}
+
+	if got, want := w.buildDir(), filepath.Join(soft, mainDir); got != want {
+		t.Errorf("buildDir() = %q, want %q", got, want)
+	}
+}
+
+func TestDetectWorkspaceGopath(t *testing.T) {
+	setTestDirs(t)
+	t.Setenv("GO111MODULE", "off")
+
+	dir := filepath.Join(gopath, "src", "github.com", "user", "app")
+	writeFiles(t, dir, map[string]string{"main.go": "package main\n"})
+
+	w, err := detectWorkspace(dir, false)
+	if err != nil {
+		t.Fatalf("detectWorkspace: %v", err)
+	}
+
+	wantTrees := []tree{{src: filepath.Join(gopath, "src"), dst: filepath.Join(softGopath, "src")}}
+	if !reflect.DeepEqual(w.trees, wantTrees) {
+		t.Errorf("trees = %+v, want %+v", w.trees, wantTrees)
+	}
+
+	if got, err := w.importPath(dir); err != nil || got != "github.com/user/app" {
+		t.Errorf("importPath(%q) = %q, %v, want %q", dir, got, err, "github.com/user/app")
+	}
+
+	if got, want := w.buildDir(), filepath.Join(softGopath, "src"); got != want {
+		t.Errorf("buildDir() = %q, want %q", got, want)
+	}
+
+	w, err = detectWorkspace(dir, true)
+	if err != nil {
+		t.Fatalf("detectWorkspace: %v", err)
+	}
+
+	path := filepath.Join(dir, "main.go")
+	if got, err := w.softPath(path); err != nil || got != filepath.Join(softDir, "o", path) {
+		t.Errorf("softPath(%q) = %q, %v, want %q", path, got, err, filepath.Join(softDir, "o", path))
+	}
+
+	if got, want := w.buildDir(), filepath.Join(gopath, "src"); got != want {
+		t.Errorf("buildDir() = %q, want %q", got, want)
+	}
+}
@@ -13,6 +13,7 @@ func main() {
 
 	http.HandleFunc("/increment", es.IncrementCounter)
 	http.HandleFunc("/get", es.GetCounter)
+	http.Handle("/debug/hot/", http.StripPrefix("/debug/hot", hot.DebugHandler()))
 
 	go hot.ReloaderLoop()
 
@@ -0,0 +1,56 @@
+package hot
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+)
+
+// ctxMocksKey is the context key for the mocks that are bound to the context.
+type ctxMocksKey struct{}
+
+// ctxMocks maps the slot of the mocked function to the mock converted to the type of the function.
+type ctxMocks map[*atomic.Value]interface{}
+
+// MockCtx returns a copy of ctx in which the src function is substituted with dst.
+// Unlike Mock it does not affect other callers, so tests that run in parallel can
+// mock the same function differently.
+//
+// Only the functions that accept a context.Context argument can be mocked this way:
+// the mock is used when the function is called with ctx or a context derived from it.
+// To call the next implementation from inside the mock call the function with the
+// parent context.
+func MockCtx(ctx context.Context, src interface{}, dst interface{}) context.Context {
+	rf, ok := lookupFunc(getFuncPtr(src))
+	if !ok {
+		panic("Function cannot be mocked, it is not registered")
+	}
+
+	if !reflect.TypeOf(dst).ConvertibleTo(reflect.TypeOf(rf.fun)) {
+		panic("Function signatures do not match")
+	}
+
+	parent, _ := ctx.Value(ctxMocksKey{}).(ctxMocks)
+	m := make(ctxMocks, len(parent)+1)
+	for k, v := range parent {
+		m[k] = v
+	}
+	m[rf.slot] = reflect.ValueOf(dst).Convert(reflect.TypeOf(rf.fun)).Interface()
+
+	// the bit is never cleared, as there is no way to know when ctx is no longer used
+	setFlagBits(rf.flag, flagCtxMocked, true)
+
+	return context.WithValue(ctx, ctxMocksKey{}, m)
+}
+
+// ContextMock is a callback that is used in rewritten files to get the mock that
+// is bound to ctx for the function with the supplied slot.
+// Do not use directly.
+func ContextMock(ctx context.Context, slot *atomic.Value) interface{} {
+	if ctx == nil {
+		return nil
+	}
+
+	m, _ := ctx.Value(ctxMocksKey{}).(ctxMocks)
+	return m[slot]
+}
@@ -0,0 +1,188 @@
+package hot
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DebugHandler returns the handler of a page that shows the functions that are registered
+// and patched, the history of reloads with the diffs that were applied and the reloads
+// that failed. The page also allows to reset a function back to the original.
+//
+// The handler can be mounted under any prefix, like net/http/pprof:
+//
+//	http.Handle("/debug/hot/", http.StripPrefix("/debug/hot", hot.DebugHandler()))
+//
+// The handler has no authentication, so serve it on a listener that is only reachable
+// from localhost or an internal network. Resets coming from other sites are rejected.
+func DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", debugIndex)
+	mux.HandleFunc("/reset", debugReset)
+	return mux
+}
+
+type debugPage struct {
+	Registered  []FuncInfo
+	Active      []FuncInfo
+	Generations []Generation
+	Failures    []reloadFailure
+	Current     int
+}
+
+func debugIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := debugPage{
+		Registered:  Registered(),
+		Active:      Active(),
+		Generations: History(),
+	}
+
+	loadMutex.Lock()
+	page.Failures = append([]reloadFailure(nil), failures...)
+	page.Current = currentGen
+	loadMutex.Unlock()
+
+	// the latest events are the most interesting ones
+	for i, j := 0, len(page.Generations)-1; i < j; i, j = i+1, j-1 {
+		page.Generations[i], page.Generations[j] = page.Generations[j], page.Generations[i]
+	}
+	for i, j := 0, len(page.Failures)-1; i < j; i, j = i+1, j-1 {
+		page.Failures[i], page.Failures[j] = page.Failures[j], page.Failures[i]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, page); err != nil {
+		log.Printf("hot: could not render debug page: %v", err)
+	}
+}
+
+func debugReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-site requests are not allowed", http.StatusForbidden)
+		return
+	}
+
+	name := r.FormValue("name")
+	if _, ok := lookupName(name); !ok {
+		http.Error(w, "No function with the name `"+name+"` is registered", http.StatusNotFound)
+		return
+	}
+
+	ResetByName(name)
+
+	// http.Redirect would resolve the location against the path with the prefix stripped,
+	// while the browser resolves it against the path the handler is mounted under
+	w.Header().Set("Location", "./")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// sameOrigin reports whether the request could not have been sent by a form on another site.
+// Browsers set Sec-Fetch-Site and older ones set Origin for POST requests, other clients
+// set neither.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	return true
+}
+
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"diffClass": func(ln string) string {
+		switch {
+		case strings.HasPrefix(ln, "+"):
+			return "add"
+		case strings.HasPrefix(ln, "-"):
+			return "del"
+		}
+		return ""
+	},
+	"lines": func(s string) []string {
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>hot</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 2px 8px; border-bottom: 1px solid #ddd; vertical-align: top; }
+pre { margin: 0; }
+.add { background: #e6ffed; }
+.del { background: #ffeef0; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+
+<h2>Active patches ({{len .Active}})</h2>
+<table>
+<tr><th>Function</th><th>Generation</th><th></th></tr>
+{{range .Active}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{if .Generation}}{{.Generation}}{{else}}-{{end}}</td>
+<td><form method="POST" action="reset"><input type="hidden" name="name" value="{{.Name}}"><button>Reset to original</button></form></td>
+</tr>
+{{end}}
+</table>
+
+<h2>Reloads (running generation {{.Current}})</h2>
+<table>
+<tr><th>Generation</th><th>Time</th><th>Source</th><th>Patched functions</th></tr>
+{{range .Generations}}
+<tr>
+<td>{{.ID}}{{if .Current}} (running){{end}}</td>
+<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+<td>{{or .Source .Plugin}}
+{{if .Diff}}<details><summary>Diff</summary><pre>{{range lines .Diff}}<span class="{{diffClass .}}">{{.}}</span>
+{{end}}</pre></details>{{end}}
+</td>
+<td>{{range .Funcs}}{{.}}<br>{{end}}</td>
+</tr>
+{{end}}
+</table>
+
+<h2>Failed reloads ({{len .Failures}})</h2>
+<table>
+<tr><th>Time</th><th>Source</th><th>Error</th></tr>
+{{range .Failures}}
+<tr>
+<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+<td>{{or .Source .Plugin}}</td>
+<td class="error"><pre>{{.Error}}</pre></td>
+</tr>
+{{end}}
+</table>
+
+<h2>Registered functions ({{len .Registered}})</h2>
+<table>
+<tr><th>Function</th><th>Signature</th><th>Position</th></tr>
+{{range .Registered}}
+<tr>
+<td>{{.Name}}</td>
+<td><code>{{.Signature}}</code></td>
+<td>{{.File}}:{{.Line}}</td>
+</tr>
+{{end}}
+</table>
+
+</body>
+</html>
+`))
@@ -0,0 +1,148 @@
+package hot
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Generation describes a reload that was applied to the running application.
+// Generation 0 is the code the application was started with.
+type Generation struct {
+	ID      int
+	Parent  int // the generation that was running when this one was applied
+	Plugin  string
+	Source  string `json:",omitempty"` // the file that was changed, if known
+	Hash    string `json:",omitempty"` // the hash of the changed file, if known
+	Diff    string `json:",omitempty"` // the changes in the file, if known
+	Time    time.Time
+	Funcs   []string // functions that were patched by the reload
+	Current bool     // whether or not the application runs the code of this generation
+}
+
+// historyEntry is the mock that was installed for a function by the generation gen.
+type historyEntry struct {
+	gen  int
+	mock interface{} // nil means the original implementation
+}
+
+// reloadFailure is a plugin that could not be loaded.
+type reloadFailure struct {
+	Time   time.Time
+	Plugin string
+	Source string
+	Error  string
+}
+
+// maxFailures is how many of the last failures are kept.
+const maxFailures = 100
+
+// The history is guarded by loadMutex.
+var (
+	generations []Generation
+	currentGen  int
+	funcHistory = make(map[funcPtr][]historyEntry)
+	failures    []reloadFailure
+)
+
+func addFailure(req ReloadRequest, err error) {
+	failures = append(failures, reloadFailure{
+		Time:   time.Now(),
+		Plugin: req.Plugin,
+		Source: req.Source,
+		Error:  err.Error(),
+	})
+
+	if len(failures) > maxFailures {
+		failures = failures[len(failures)-maxFailures:]
+	}
+}
+
+// addGeneration records the changes made by the plugin that was loaded successfully.
+func addGeneration(st *loadState, req ReloadRequest) int {
+	g := Generation{
+		ID:     len(generations) + 1,
+		Parent: currentGen,
+		Plugin: req.Plugin,
+		Source: req.Source,
+		Hash:   req.Hash,
+		Diff:   req.Diff,
+		Time:   time.Now(),
+	}
+
+	for fHash, prev := range st.saved {
+		h := funcHistory[fHash]
+		if len(h) == 0 {
+			// the function was changed by a reload for the first time
+			h = append(h, historyEntry{gen: 0, mock: prev.mock})
+		}
+
+		mocksMutex.Lock()
+		cur := mocks[fHash]
+		mocksMutex.Unlock()
+
+		funcHistory[fHash] = append(h, historyEntry{gen: g.ID, mock: cur})
+	}
+
+	g.Funcs = append([]string(nil), st.patched...)
+	sort.Strings(g.Funcs)
+
+	generations = append(generations, g)
+	currentGen = g.ID
+	return g.ID
+}
+
+// History returns the reloads that were applied to the running application, oldest first.
+func History() []Generation {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	res := make([]Generation, 0, len(generations))
+	for _, g := range generations {
+		g.Funcs = append([]string(nil), g.Funcs...)
+		g.Current = g.ID == currentGen
+		res = append(res, g)
+	}
+	return res
+}
+
+// Rollback returns all the functions changed by reloads to the state they were in
+// right after the generation gen was applied. Rollback(0) returns to the code the
+// application was started with. Later generations are kept, so it is possible
+// to roll forward to them as well. A reload after a rollback starts a new branch
+// on top of the generation that was rolled back to.
+func Rollback(gen int) error {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	if gen < 0 || gen > len(generations) {
+		return fmt.Errorf("no generation %d, the last one is %d", gen, len(generations))
+	}
+
+	for fHash := range funcHistory {
+		restoreMock(fHash, mockAt(fHash, gen))
+	}
+
+	currentGen = gen
+	return nil
+}
+
+// mockAt returns the entry for the mock that the function had right after the generation gen
+// was applied. It is the one installed by gen itself or by the closest generation it was applied
+// on top of: after a rollback new generations branch off and do not include the ones that were
+// rolled back.
+func mockAt(fHash funcPtr, gen int) historyEntry {
+	h := funcHistory[fHash]
+	for {
+		for _, e := range h {
+			if e.gen == gen {
+				return e
+			}
+		}
+
+		if gen == 0 {
+			return historyEntry{}
+		}
+		gen = generations[gen-1].Parent
+	}
+}
@@ -1,15 +1,32 @@
 package hot
 
-import "reflect"
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
 
 type (
 	funcPtr uintptr
 	flagPtr *int32 // flag pointer indicates that there exists a mock and is atomically read and written
 )
 
-var pkgFlags = make(map[funcPtr]flagPtr)
-var pkgPtrs = make(map[string]funcPtr)
-var pkgFuncs = make(map[funcPtr]interface{})
+// registeredFunc is the function that can be mocked.
+type registeredFunc struct {
+	flag flagPtr
+	slot *atomic.Value // the mock converted to the type of fun, or nil func of that type
+	fun  interface{}
+	orig interface{} // the copy of fun without the interceptor, of the same type
+}
+
+// Functions are registered from init() of the rewritten packages, including the ones
+// in plugins that are loaded while the application is running, so the registry
+// is guarded by a mutex.
+var (
+	registryMutex sync.RWMutex
+	pkgFuncs      = make(map[funcPtr]registeredFunc)
+	pkgPtrs       = make(map[string]funcPtr)
+)
 
 func getFuncPtr(f interface{}) funcPtr {
 	return funcPtr(reflect.ValueOf(f).Pointer())
@@ -17,10 +34,35 @@ func getFuncPtr(f interface{}) funcPtr {
 
 // RegisterFunc is a callback that is used in rewritten files to register
 // the function so that it can be mocked.
+// The rewritten function loads the mock from the slot when the flag p is set,
+// so calling it does not involve any locks. Orig is the copy of the function
+// without the interceptor that is used to call the original implementation.
 // Do not use directly.
-func RegisterFunc(fun interface{}, name string, p *int32) {
+func RegisterFunc(fun interface{}, orig interface{}, name string, p *int32, slot *atomic.Value) {
 	f := getFuncPtr(fun)
-	pkgFlags[f] = flagPtr(p)
-	pkgFuncs[f] = fun
+
+	// the slot always holds a value of the same type, as required by atomic.Value
+	slot.Store(reflect.Zero(reflect.TypeOf(fun)).Interface())
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	pkgFuncs[f] = registeredFunc{flag: flagPtr(p), slot: slot, fun: fun, orig: orig}
 	pkgPtrs[name] = f
 }
+
+func lookupFunc(fHash funcPtr) (registeredFunc, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	rf, ok := pkgFuncs[fHash]
+	return rf, ok
+}
+
+func lookupName(name string) (funcPtr, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	ptr, ok := pkgPtrs[name]
+	return ptr, ok
+}
@@ -0,0 +1,61 @@
+package hot
+
+import (
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+// FuncInfo describes a function that is registered for mocking.
+type FuncInfo struct {
+	Name      string // in MockByName format
+	Signature string // for methods the receiver is the first argument
+	File      string // the position of the function in the original source
+	Line      int
+
+	Patched    bool // whether or not a mock is installed for the function
+	Generation int  // the reload generation that installed the mock, 0 if it was not installed by a reload
+}
+
+// Registered returns all the functions that can be mocked, sorted by name.
+// It can be used to check that the expected packages were instrumented.
+func Registered() []FuncInfo {
+	return funcInfos(false)
+}
+
+// Active returns the functions that have a mock installed, sorted by name.
+func Active() []FuncInfo {
+	return funcInfos(true)
+}
+
+func funcInfos(onlyPatched bool) []FuncInfo {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	mocksMutex.Lock()
+	defer mocksMutex.Unlock()
+
+	var res []FuncInfo
+	for name, fHash := range pkgPtrs {
+		_, patched := mocks[fHash]
+		if onlyPatched && !patched {
+			continue
+		}
+
+		info := FuncInfo{
+			Name:       name,
+			Signature:  reflect.TypeOf(pkgFuncs[fHash].fun).String(),
+			Patched:    patched,
+			Generation: mockGens[fHash],
+		}
+
+		if f := runtime.FuncForPC(uintptr(fHash)); f != nil {
+			info.File, info.Line = f.FileLine(f.Entry())
+		}
+
+		res = append(res, info)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
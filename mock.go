@@ -9,6 +9,71 @@ import (
 var mocksMutex sync.Mutex
 var mocks = make(map[funcPtr]interface{})
 
+// mockGens is the reload generation that installed the mock of a function, if any.
+// It is guarded by mocksMutex.
+var mockGens = make(map[funcPtr]int)
+
+// loading tracks the changes made by the plugin that is being loaded, nil otherwise.
+// It is guarded by mocksMutex.
+var loading *loadState
+
+type loadState struct {
+	gen     int                      // the generation the plugin becomes if it is loaded
+	patched []string                 // functions mocked by the plugin
+	saved   map[funcPtr]historyEntry // mocks that were in place before the plugin changed them
+}
+
+// beginLoad starts tracking the changes made by the plugin.
+// It must be called with loadMutex held.
+func beginLoad() {
+	mocksMutex.Lock()
+	defer mocksMutex.Unlock()
+
+	loading = &loadState{gen: len(generations) + 1, patched: []string{}, saved: make(map[funcPtr]historyEntry)}
+}
+
+// endLoad stops tracking the changes and returns them.
+// If restore is true then the changes are rolled back.
+func endLoad(restore bool) *loadState {
+	mocksMutex.Lock()
+	st := loading
+	loading = nil
+	mocksMutex.Unlock()
+
+	if restore {
+		for fHash, prev := range st.saved {
+			restoreMock(fHash, prev)
+		}
+	}
+	return st
+}
+
+// restoreMock sets the mock prev that was in place before for the function or
+// resets it if there was none.
+func restoreMock(fHash funcPtr, prev historyEntry) {
+	if prev.mock == nil {
+		reset(fHash)
+	} else {
+		setMock(fHash, prev.mock, prev.gen)
+	}
+}
+
+// track records that the plugin that is being loaded (if any) changes the function.
+func track(fHash funcPtr, name string, patched bool) {
+	mocksMutex.Lock()
+	defer mocksMutex.Unlock()
+
+	if loading == nil {
+		return
+	}
+	if _, ok := loading.saved[fHash]; !ok {
+		loading.saved[fHash] = historyEntry{gen: mockGens[fHash], mock: mocks[fHash]}
+	}
+	if patched {
+		loading.patched = append(loading.patched, name)
+	}
+}
+
 // Mock substitutes the src function with dst in runtime.
 // In order to pass function pointers to methods you need to write
 // the following expression: `(*typeName).MethodName`.
@@ -16,18 +81,30 @@ func Mock(src interface{}, dst interface{}) {
 	mock(getFuncPtr(src), dst)
 }
 
-func mock(fHash funcPtr, dst interface{}) {
-	fl, ok := pkgFlags[fHash]
+// mock returns the mock that was in place before, if any.
+// Mocks set while a plugin is loaded are attributed to it's generation.
+func mock(fHash funcPtr, dst interface{}) (prev historyEntry) {
+	mocksMutex.Lock()
+	gen := 0
+	if loading != nil {
+		gen = loading.gen
+	}
+	mocksMutex.Unlock()
+
+	return setMock(fHash, dst, gen)
+}
+
+// setMock installs dst as the mock that was set by the generation gen.
+func setMock(fHash funcPtr, dst interface{}, gen int) (prev historyEntry) {
+	rf, ok := lookupFunc(fHash)
 	if !ok {
 		panic("Function cannot be mocked, it is not registered")
 	}
 
-	if !reflect.TypeOf(dst).ConvertibleTo(reflect.TypeOf(pkgFuncs[fHash])) {
+	if !reflect.TypeOf(dst).ConvertibleTo(reflect.TypeOf(rf.fun)) {
 		panic("Function signatures do not match")
 	}
 
-	setFlag(fl, true)
-
 	// There can be some point in time when the flag is set
 	// but the mock does not yet exist.
 	//
@@ -38,17 +115,53 @@ func mock(fHash funcPtr, dst interface{}) {
 	// This is why the rewritten code basically looks like this:
 	//
 	// if atomic.LoadInt32(<flag for the specific function>) != 0 {
-	//   // <--- the mock can be deleted from the table at this point in time
-	//   if soft := hot.GetMockFor(<function pointer>); soft != nil {
+	//   // <--- the mock can be deleted from the slot at this point in time
+	//   if soft, _ := <slot for the specific function>.Load().(<func type>); soft != nil {
 	//	   <execute the mock>
 	//     return
 	//   }
 	// }
+	//
+	// The flag is changed while holding the mutex, so that concurrent mock and reset
+	// of the same function can't leave the flag unset while the mock exists.
 
 	mocksMutex.Lock()
 	defer mocksMutex.Unlock()
 
+	rf.slot.Store(reflect.ValueOf(dst).Convert(reflect.TypeOf(rf.fun)).Interface())
+	setFlag(rf.flag, true)
+	prev = historyEntry{gen: mockGens[fHash], mock: mocks[fHash]}
 	mocks[fHash] = dst
+	if gen != 0 {
+		mockGens[fHash] = gen
+	} else {
+		delete(mockGens, fHash)
+	}
+	return prev
+}
+
+// MockScoped is like Mock, but it returns a function that puts back the mock that was
+// in place for src before (or the original implementation if there was none).
+// Mocks of the same function can be stacked as long as they are restored in reverse order.
+func MockScoped(src interface{}, dst interface{}) (restore func()) {
+	fHash := getFuncPtr(src)
+	prev := mock(fHash, dst)
+	return func() { restoreMock(fHash, prev) }
+}
+
+// TB is the part of testing.TB that the test helpers use. It is satisfied by *testing.T and *testing.B
+// and keeps the testing package out of the binaries that import hot.
+type TB interface {
+	Helper()
+	Cleanup(func())
+	Errorf(format string, args ...interface{})
+}
+
+// MockT substitutes the src function with dst until the test t and it's subtests complete.
+// The mock that was in place before is restored afterwards, so mocks can be nested.
+func MockT(t TB, src interface{}, dst interface{}) {
+	t.Helper()
+	t.Cleanup(MockScoped(src, dst))
 }
 
 // MockByName mocks the function by it's name src. Dst is the function that should replace src.
@@ -61,36 +174,49 @@ func mock(fHash funcPtr, dst interface{}) {
 // 3. For value methods it is "package/receiverType.MethodName":
 //       E.g. for `IsZero` method of `time.Time` it would be "time/Time.IsZero"
 func MockByName(src string, dst interface{}) {
-	ptr, ok := pkgPtrs[src]
+	ptr, ok := lookupName(src)
 	if !ok {
 		panic("No function with the name `" + src + "` is registered")
 	}
+	track(ptr, src, true)
 	mock(ptr, dst)
 }
 
-func getFlag(h flagPtr) bool {
-	return atomic.LoadInt32((*int32)(h)) != 0
-}
+// The flag of a function is a set of bits, the rewritten function only checks
+// for mocks when it is not zero.
+const (
+	flagMocked    = 1 << iota // there is a mock set by Mock()
+	flagCtxMocked             // there are mocks bound to contexts by MockCtx()
+)
 
 func setFlag(h flagPtr, v bool) {
-	vInt := int32(0)
-	if v {
-		vInt = 1
-	}
+	setFlagBits(h, flagMocked, v)
+}
 
-	atomic.StoreInt32((*int32)(h), vInt)
+func setFlagBits(h flagPtr, bits int32, v bool) {
+	for {
+		old := atomic.LoadInt32((*int32)(h))
+		val := old &^ bits
+		if v {
+			val = old | bits
+		}
+
+		if atomic.CompareAndSwapInt32((*int32)(h), old, val) {
+			return
+		}
+	}
 }
 
 // CallOriginal calls the original implementation of the function f.
-// Note that the behaviour of recursive functions is not defined.
+// Recursive calls made by the original implementation go through the mock.
 func CallOriginal(f interface{}, args ...interface{}) []interface{} {
 	return callOriginal(getFuncPtr(f), args)
 }
 
 // CallOriginalByName calls the original implementation of the function f.
-// Note that the behaviour of recursive functions is not defined.
+// Recursive calls made by the original implementation go through the mock.
 func CallOriginalByName(f string, args ...interface{}) []interface{} {
-	ptr, ok := pkgPtrs[f]
+	ptr, ok := lookupName(f)
 	if !ok {
 		panic("No function with the name `" + f + "` is registered")
 	}
@@ -98,22 +224,17 @@ func CallOriginalByName(f string, args ...interface{}) []interface{} {
 }
 
 func callOriginal(fHash funcPtr, args []interface{}) []interface{} {
-	fl, ok := pkgFlags[fHash]
+	rf, ok := lookupFunc(fHash)
 	if !ok {
 		panic("Function is not registered")
 	}
 
-	if getFlag(fl) {
-		setFlag(fl, false)
-		defer setFlag(fl, true)
-	}
-
 	in := make([]reflect.Value, 0, len(args))
 	for _, arg := range args {
 		in = append(in, reflect.ValueOf(arg))
 	}
 
-	out := reflect.ValueOf(pkgFuncs[fHash]).Call(in)
+	out := callOriginalValues(rf, in, false)
 	res := make([]interface{}, 0, len(out))
 	for _, v := range out {
 		res = append(res, v.Interface())
@@ -122,8 +243,19 @@ func callOriginal(fHash funcPtr, args []interface{}) []interface{} {
 	return res
 }
 
+// callOriginalValues calls the original implementation of rf. If slice is true
+// then the last argument is the slice of variadic arguments.
+// The copy of the function without the interceptor is called, so the mock stays
+// in place for other callers and for recursive calls.
+func callOriginalValues(rf registeredFunc, in []reflect.Value, slice bool) []reflect.Value {
+	if slice {
+		return reflect.ValueOf(rf.orig).CallSlice(in)
+	}
+	return reflect.ValueOf(rf.orig).Call(in)
+}
+
 func reset(fHash funcPtr) {
-	fl, ok := pkgFlags[fHash]
+	rf, ok := lookupFunc(fHash)
 	if !ok {
 		return
 	}
@@ -133,22 +265,23 @@ func reset(fHash funcPtr) {
 	// mocks table whether or not there is an actual mock for it or not.
 	//
 	// Even if we set the flag to false in before deleting it from the
-	// mocks map the actual code that is executed can check for the flag
+	// slot the actual code that is executed can check for the flag
 	// (and see that it's true), then get descheduled and then return
 	// to the execution much later and try to get the mock that no longer
 	// exists.
 	//
 	// So in the interceptor code there are two checks:
 	//  1. Check that the flag is true
-	//  2. Get the mock while holding the mutex and check once
+	//  2. Load the mock from the slot and check once
 	//     again that it's still there.
 
-	setFlag(fl, false)
-
 	mocksMutex.Lock()
 	defer mocksMutex.Unlock()
 
+	setFlag(rf.flag, false)
+	rf.slot.Store(reflect.Zero(reflect.TypeOf(rf.fun)).Interface())
 	delete(mocks, fHash)
+	delete(mockGens, fHash)
 }
 
 // Reset removes the mock that was set up for the function f,
@@ -162,16 +295,24 @@ func Reset(f interface{}) {
 // returning it to the original implementation.
 // If there were no mocks set up for the function it is a noop.
 func ResetByName(src string) {
-	ptr, ok := pkgPtrs[src]
+	ptr, ok := lookupName(src)
 	if !ok {
 		return
 	}
+	track(ptr, src, false)
 	reset(ptr)
 }
 
 // ResetAll removes the mocks that were set up for all functions.
 func ResetAll() {
+	mocksMutex.Lock()
+	ptrs := make([]funcPtr, 0, len(mocks))
 	for ptr := range mocks {
+		ptrs = append(ptrs, ptr)
+	}
+	mocksMutex.Unlock()
+
+	for _, ptr := range ptrs {
 		reset(ptr)
 	}
 }
@@ -0,0 +1,479 @@
+package hot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func registered(i int) int { return i }
+
+func other(i int) int { return -i }
+
+var (
+	registeredFlag int32
+	registeredSlot atomic.Value
+	otherFlag      int32
+	otherSlot      atomic.Value
+	discardLogger  = log.New(ioutil.Discard, "", 0)
+)
+
+func TestConcurrentRegistryAccess(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				var fl int32
+				var slot atomic.Value
+				RegisterFunc(func() {}, func() {}, fmt.Sprintf("hot/f%d_%d", i, j), &fl, &slot)
+
+				MockByName("hot/registered", func(i int) int { return i + 1 })
+				GetMockFor(registered)
+				CallOriginalByName("hot/registered", j)
+				ResetByName("hot/registered")
+				ResetAll()
+			}
+		}(i)
+	}
+
+	res := load(ReloadRequest{Plugin: "/nonexistent.so"}, discardLogger)
+	wg.Wait()
+
+	if res.OK {
+		t.Errorf("Loading a missing plugin succeeded")
+	}
+	if GetMockFor(registered) != nil {
+		t.Errorf("Mock is left after ResetAll")
+	}
+}
+
+func TestMockByNameSignatureMismatch(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("MockByName with a wrong signature did not panic")
+		}
+		if GetMockFor(registered) != nil {
+			t.Errorf("Mock with a wrong signature was set")
+		}
+	}()
+
+	MockByName("hot/registered", func() {})
+}
+
+func TestFailedLoadRestoresMocks(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	defer ResetAll()
+
+	prev := func(i int) int { return i + 1 }
+	MockByName("hot/registered", prev)
+
+	beginLoad()
+	ResetByName("hot/registered")
+	MockByName("hot/registered", func(i int) int { return i + 2 })
+	endLoad(true)
+
+	if m := GetMockFor(registered); m == nil || reflect.ValueOf(m).Pointer() != reflect.ValueOf(prev).Pointer() {
+		t.Errorf("Previous mock was not restored, got %v", m)
+	}
+}
+
+type handler func(int) int
+
+func TestMockIsStoredInSlot(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	defer ResetAll()
+
+	// mocks of a convertible type are stored with the type of the registered function
+	MockByName("hot/registered", handler(func(i int) int { return i * 10 }))
+
+	if atomic.LoadInt32(&registeredFlag) == 0 {
+		t.Fatalf("Flag is not set after MockByName")
+	}
+	soft, _ := registeredSlot.Load().(func(int) int)
+	if soft == nil {
+		t.Fatalf("Slot is empty after MockByName")
+	}
+	if got := soft(2); got != 20 {
+		t.Errorf("Mock from the slot returned %d, want 20", got)
+	}
+
+	ResetByName("hot/registered")
+
+	if atomic.LoadInt32(&registeredFlag) != 0 {
+		t.Errorf("Flag is set after ResetByName")
+	}
+	if soft, _ := registeredSlot.Load().(func(int) int); soft != nil {
+		t.Errorf("Slot is not empty after ResetByName")
+	}
+}
+
+func TestMockTStacks(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	defer ResetAll()
+
+	call := func() int {
+		if soft, _ := registeredSlot.Load().(func(int) int); soft != nil {
+			return soft(1)
+		}
+		return registered(1)
+	}
+
+	t.Run("outer", func(t *testing.T) {
+		MockT(t, registered, func(i int) int { return i + 10 })
+
+		t.Run("inner", func(t *testing.T) {
+			MockT(t, registered, func(i int) int { return i + 20 })
+			MockT(t, registered, func(i int) int { return i + 30 })
+
+			if got := call(); got != 31 {
+				t.Errorf("Innermost mock returned %d, want 31", got)
+			}
+		})
+
+		if got := call(); got != 11 {
+			t.Errorf("Outer mock was not restored, got %d, want 11", got)
+		}
+	})
+
+	if got := call(); got != 1 {
+		t.Errorf("Original was not restored, got %d, want 1", got)
+	}
+}
+
+func TestMockCtx(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	defer ResetAll()
+
+	ctx := MockCtx(context.Background(), registered, func(i int) int { return i + 10 })
+	child := MockCtx(ctx, registered, func(i int) int { return i + 20 })
+
+	if atomic.LoadInt32(&registeredFlag) == 0 {
+		t.Fatalf("Flag is not set after MockCtx")
+	}
+
+	for _, tc := range []struct {
+		ctx  context.Context
+		want int
+	}{
+		{context.Background(), 0},
+		{ctx, 11},
+		{child, 21},
+		{context.WithValue(child, struct{}{}, 1), 21},
+	} {
+		got := 0
+		if soft, _ := ContextMock(tc.ctx, &registeredSlot).(func(int) int); soft != nil {
+			got = soft(1)
+		}
+		if got != tc.want {
+			t.Errorf("Mock bound to the context returned %d, want %d (0 means no mock)", got, tc.want)
+		}
+	}
+}
+
+func TestSpy(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	defer ResetAll()
+
+	r := SpyT(t, registered)
+
+	soft, _ := registeredSlot.Load().(func(int) int)
+	if soft == nil {
+		t.Fatalf("Spy is not installed")
+	}
+
+	for _, i := range []int{1, 2, 2} {
+		if got := soft(i); got != i {
+			t.Errorf("Spy returned %d, want %d", got, i)
+		}
+	}
+
+	r.AssertCalled(t, 3)
+	r.AssertCalledWith(t, 2, 2)
+	r.AssertCalledWith(t, 0, 3)
+
+	if c := r.Calls()[0]; !reflect.DeepEqual(c.Results, []interface{}{1}) {
+		t.Errorf("First call recorded results %v, want [1]", c.Results)
+	}
+
+	r.Restore()
+	if soft, _ := registeredSlot.Load().(func(int) int); soft != nil {
+		t.Errorf("Spy is still installed after Restore")
+	}
+}
+
+// simulateReload changes the function the way Mock() from a plugin does.
+func simulateReload(dst func(int) int) int {
+	return simulateReloadOf("hot/registered", dst)
+}
+
+// simulateReloadOf changes the function name the way Mock() from a plugin does.
+func simulateReloadOf(name string, dst func(int) int) int {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	beginLoad()
+	ResetByName(name)
+	MockByName(name, dst)
+	return addGeneration(endLoad(false), ReloadRequest{Plugin: "plug.so"})
+}
+
+func TestRollback(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	defer ResetAll()
+
+	call := func() int {
+		if soft, _ := registeredSlot.Load().(func(int) int); soft != nil {
+			return soft(1)
+		}
+		return registered(1)
+	}
+
+	first := simulateReload(func(i int) int { return i + 10 })
+	second := simulateReload(func(i int) int { return i + 20 })
+
+	for _, tc := range []struct {
+		gen  int
+		want int
+	}{
+		{first, 11},
+		{0, 1},
+		{second, 21},
+	} {
+		if err := Rollback(tc.gen); err != nil {
+			t.Fatalf("Rollback(%d): %v", tc.gen, err)
+		}
+		if got := call(); got != tc.want {
+			t.Errorf("After Rollback(%d) the function returned %d, want %d", tc.gen, got, tc.want)
+		}
+	}
+
+	if err := Rollback(second + 1); err == nil {
+		t.Errorf("Rollback to a generation that does not exist succeeded")
+	}
+
+	h := History()
+	if len(h) < 2 || !h[len(h)-1].Current || !reflect.DeepEqual(h[len(h)-1].Funcs, []string{"hot/registered"}) {
+		t.Errorf("Unexpected history: %+v", h)
+	}
+}
+
+func TestReloadAfterRollback(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	RegisterFunc(other, other, "hot/other", &otherFlag, &otherSlot)
+	defer ResetAll()
+
+	call := func() int {
+		if soft, _ := otherSlot.Load().(func(int) int); soft != nil {
+			return soft(1)
+		}
+		return other(1)
+	}
+
+	simulateReloadOf("hot/registered", func(i int) int { return i + 10 })
+	second := simulateReloadOf("hot/other", func(i int) int { return i + 20 })
+
+	if err := Rollback(0); err != nil {
+		t.Fatalf("Rollback(0): %v", err)
+	}
+	third := simulateReloadOf("hot/registered", func(i int) int { return i + 30 })
+
+	if h := History(); h[len(h)-1].Parent != 0 {
+		t.Errorf("Generation %d was applied on top of %d, want 0", third, h[len(h)-1].Parent)
+	}
+
+	for _, tc := range []struct {
+		gen  int
+		want int
+	}{
+		{second, 21},
+		// the mock of other was installed by a generation that is not on the way to the third one
+		{third, -1},
+	} {
+		if err := Rollback(tc.gen); err != nil {
+			t.Fatalf("Rollback(%d): %v", tc.gen, err)
+		}
+		if got := call(); got != tc.want {
+			t.Errorf("After Rollback(%d) other returned %d, want %d", tc.gen, got, tc.want)
+		}
+	}
+
+	for _, info := range Active() {
+		if info.Name == "hot/other" {
+			t.Errorf("hot/other is active in generation %d: %+v", third, info)
+		}
+	}
+}
+
+func TestRegisteredAndActive(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	defer ResetAll()
+
+	find := func(infos []FuncInfo) *FuncInfo {
+		for i := range infos {
+			if infos[i].Name == "hot/registered" {
+				return &infos[i]
+			}
+		}
+		return nil
+	}
+
+	info := find(Registered())
+	if info == nil {
+		t.Fatalf("hot/registered is not in Registered()")
+	}
+	if info.Signature != "func(int) int" || !strings.HasSuffix(info.File, "mock_test.go") || info.Patched {
+		t.Errorf("Unexpected info for an unpatched function: %+v", info)
+	}
+	if find(Active()) != nil {
+		t.Errorf("hot/registered is active before it was mocked")
+	}
+
+	dst := func(i int) int { return i + 1 }
+	gen := simulateReload(dst)
+
+	info = find(Active())
+	if info == nil || !info.Patched || info.Generation != gen {
+		t.Errorf("Unexpected info for a function patched by generation %d: %+v", gen, info)
+	}
+
+	// the same function installed directly is not attributed to the reload
+	MockByName("hot/registered", dst)
+
+	if info = find(Active()); info == nil || info.Generation != 0 {
+		t.Errorf("Unexpected info for a function mocked directly: %+v", info)
+	}
+
+	if err := Rollback(gen); err != nil {
+		t.Fatal(err)
+	}
+	if info = find(Active()); info == nil || info.Generation != gen {
+		t.Errorf("Unexpected info after a rollback to generation %d: %+v", gen, info)
+	}
+
+	// Mock() of a plugin can list the functions while it is loaded
+	loadMutex.Lock()
+	beginLoad()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Registered()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Registered() blocks while a plugin is loaded")
+	}
+	endLoad(true)
+	loadMutex.Unlock()
+}
+
+func TestDebugHandler(t *testing.T) {
+	RegisterFunc(registered, registered, "hot/registered", &registeredFlag, &registeredSlot)
+	defer ResetAll()
+
+	simulateReload(func(i int) int { return i + 1 })
+
+	srv := httptest.NewServer(http.StripPrefix("/debug/hot", DebugHandler()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/debug/hot/")
+	if err != nil {
+		t.Fatalf("Could not get the debug page: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "hot/registered") {
+		t.Fatalf("Debug page does not list hot/registered (status %d):\n%s", resp.StatusCode, body)
+	}
+
+	crossSite := []http.Header{
+		{"Sec-Fetch-Site": {"cross-site"}},
+		{"Origin": {"http://example.com"}},
+	}
+	for _, h := range crossSite {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/debug/hot/reset", strings.NewReader("name=hot/registered"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = h
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not send the request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden || GetMockFor(registered) == nil {
+			t.Errorf("Cross-site reset with %v was not rejected: %d", h, resp.StatusCode)
+		}
+	}
+
+	resp, err = http.PostForm(srv.URL+"/debug/hot/reset", url.Values{"name": {"hot/registered"}})
+	if err != nil {
+		t.Fatalf("Could not reset the function: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/debug/hot/" {
+		t.Errorf("Reset did not redirect back to the debug page: %d %s", resp.StatusCode, resp.Request.URL)
+	}
+	if GetMockFor(registered) != nil {
+		t.Errorf("Function was not reset")
+	}
+}
+
+func TestResponseIsSentBeforeOnError(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	gotResponse := make(chan ReloadResponse, 1)
+	called := make(chan struct{})
+
+	go serveConn(server, ReloaderOptions{
+		Logger: discardLogger,
+		OnError: func(err error) {
+			defer close(called)
+			select {
+			case <-gotResponse:
+			case <-time.After(time.Second):
+				t.Errorf("OnError(%v) was called before the response was sent", err)
+			}
+		},
+	})
+
+	if err := json.NewEncoder(client).Encode(ReloadRequest{Plugin: "/nonexistent.so"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var res ReloadResponse
+	if err := json.NewDecoder(client).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	gotResponse <- res
+
+	<-called
+	if res.OK || res.Error == "" {
+		t.Errorf("Loading a missing plugin succeeded: %+v", res)
+	}
+}
@@ -2,38 +2,239 @@ package hot
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"plugin"
 	"strings"
+	"sync"
 )
 
+// SocketEnv is the environment variable that holds the path to the control socket.
+// When it is set, ReloaderLoop listens on the Unix domain socket instead of reading stdin.
+const SocketEnv = "HOT_SOCKET"
+
+// Commands that can be sent over the control socket.
+const (
+	CommandLoad     = "load" // the default
+	CommandHistory  = "history"
+	CommandRollback = "rollback"
+)
+
+// ReloadRequest asks the application to load the plugin from Plugin path
+// or to execute another command.
+// Requests and responses are sent over the control socket as JSON, one per line.
+type ReloadRequest struct {
+	Command    string `json:",omitempty"`
+	Plugin     string `json:",omitempty"`
+	Source     string `json:",omitempty"` // the changed file the plugin was built from
+	Hash       string `json:",omitempty"` // the hash of the changed file
+	Diff       string `json:",omitempty"` // the changes in the file that the plugin applies
+	Generation int    `json:",omitempty"` // the generation to roll back to
+}
+
+// ReloadResponse reports the result of loading the plugin or of the command.
+type ReloadResponse struct {
+	OK          bool
+	Patched     []string     // names of the functions that were patched, in MockByName format
+	Generation  int          `json:",omitempty"` // the generation that is running after the command
+	Generations []Generation `json:",omitempty"` // the result of CommandHistory
+	Error       string       `json:",omitempty"`
+	Panic       string       `json:",omitempty"` // set if the plugin panicked while applying the patches
+}
+
+// loadMutex makes sure that plugins are loaded one at a time.
+var loadMutex sync.Mutex
+
+// ReloaderOptions configure ReloaderLoopWithOptions.
+type ReloaderOptions struct {
+	// Input is where plugin paths are read from, one per line.
+	// If it is nil then the control socket from SocketEnv is used if set and os.Stdin otherwise.
+	Input io.Reader
+
+	// OnError is called when a plugin can't be loaded or when the input fails.
+	// The previous code keeps running. If it is nil then the error is logged.
+	OnError func(error)
+
+	// Logger is used for progress messages. If it is nil then they are written to os.Stderr.
+	Logger *log.Logger
+}
+
 // ReloaderLoop starts a loop that loads new plugins
 // and applies patches to existing functions.
+// It terminates the application if a plugin read from stdin can't be loaded,
+// use ReloaderLoopWithOptions to handle the errors instead. Failures of plugins
+// sent over the control socket are only logged, because they are reported
+// back to hot, which restarts the application by itself.
 // Suggested usage: `go hot.ReloaderLoop()`
 func ReloaderLoop() {
-	r := bufio.NewReader(os.Stdin)
+	var opts ReloaderOptions
+	if os.Getenv(SocketEnv) == "" {
+		opts.OnError = func(err error) { log.Fatalf("hot.Reloader: %v", err) }
+	}
+	ReloaderLoopWithOptions(opts)
+}
+
+// ReloaderLoopWithOptions is like ReloaderLoop, but it reports errors to opts.OnError
+// instead of terminating the application. It returns when the input is closed.
+// Suggested usage: `go hot.ReloaderLoopWithOptions(hot.ReloaderOptions{...})`
+func ReloaderLoopWithOptions(opts ReloaderOptions) {
+	if opts.Logger == nil {
+		opts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) { opts.Logger.Printf("hot.Reloader: %v", err) }
+	}
+
+	if opts.Input == nil {
+		if path := os.Getenv(SocketEnv); path != "" {
+			socketLoop(path, opts)
+			return
+		}
+		opts.Input = os.Stdin
+	}
+
+	r := bufio.NewReader(opts.Input)
 
 	for {
 		ln, err := r.ReadString('\n')
 		if err != nil {
-			log.Fatalf("hot.Reloader failed reading from stdin: %v", err)
+			opts.OnError(fmt.Errorf("failed reading plugin paths: %v", err))
+			return
 		}
 
 		plugPath := strings.TrimRight(ln, "\n")
 
-		log.Printf("Opening plugin %s", plugPath)
-		plug, err := plugin.Open(plugPath)
-		if err != nil {
-			log.Fatalf("Couldn't open the plugin: %v", err)
+		if err := load(ReloadRequest{Plugin: plugPath}, opts.Logger).err(); err != nil {
+			opts.OnError(err)
 		}
-		sym, err := plug.Lookup("Mock")
+	}
+}
+
+func socketLoop(path string, opts ReloaderOptions) {
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		opts.OnError(fmt.Errorf("failed to listen on %s: %v", path, err))
+		return
+	}
+
+	for {
+		conn, err := l.Accept()
 		if err != nil {
-			log.Fatalf("Couldn't open the symbol Mock: %v", err)
+			opts.OnError(fmt.Errorf("failed to accept connection: %v", err))
+			return
 		}
+		go serveConn(conn, opts)
+	}
+}
+
+func serveConn(conn net.Conn, opts ReloaderOptions) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
 
-		log.Printf("Calling Mock() from a plugin")
-		sym.(func())()
-		log.Printf("Hot reload was successful")
+	for {
+		var req ReloadRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		var res ReloadResponse
+		switch req.Command {
+		case "", CommandLoad:
+			res = load(req, opts.Logger)
+		case CommandHistory:
+			res = ReloadResponse{OK: true, Generations: History()}
+		case CommandRollback:
+			if err := Rollback(req.Generation); err != nil {
+				res.Error = err.Error()
+			} else {
+				opts.Logger.Printf("Rolled back to generation %d", req.Generation)
+				res = ReloadResponse{OK: true, Generation: req.Generation}
+			}
+		default:
+			res.Error = fmt.Sprintf("Unknown command %q", req.Command)
+		}
+
+		encErr := enc.Encode(res)
+
+		// the response goes first, because OnError can terminate the application
+		if req.Command == "" || req.Command == CommandLoad {
+			if err := res.err(); err != nil {
+				opts.OnError(err)
+			}
+		}
+
+		if encErr != nil {
+			opts.Logger.Printf("hot.Reloader failed to send response: %v", encErr)
+			return
+		}
 	}
 }
+
+// err returns the reason why the plugin was not loaded, if any.
+func (r ReloadResponse) err() error {
+	if r.Panic != "" {
+		return fmt.Errorf("plugin panicked: %s", r.Panic)
+	} else if !r.OK {
+		return errors.New(r.Error)
+	}
+	return nil
+}
+
+// load opens the plugin and calls the Mock() function from it.
+func load(req ReloadRequest, logger *log.Logger) (res ReloadResponse) {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	plugPath := req.Plugin
+
+	beginLoad()
+	defer func() {
+		// the previous code keeps running as if the plugin was never loaded
+		st := endLoad(!res.OK)
+		if res.OK {
+			res.Patched = st.patched
+			res.Generation = addGeneration(st, req)
+		} else {
+			addFailure(req, res.err())
+		}
+	}()
+
+	logger.Printf("Opening plugin %s", plugPath)
+	plug, err := plugin.Open(plugPath)
+	if err != nil {
+		res.Error = fmt.Sprintf("Couldn't open the plugin: %v", err)
+		return res
+	}
+	sym, err := plug.Lookup("Mock")
+	if err != nil {
+		res.Error = fmt.Sprintf("Couldn't open the symbol Mock: %v", err)
+		return res
+	}
+	mockFunc, ok := sym.(func())
+	if !ok {
+		res.Error = fmt.Sprintf("Symbol Mock has unexpected type %T", sym)
+		return res
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			res.Panic = fmt.Sprint(r)
+		}
+	}()
+
+	logger.Printf("Calling Mock() from a plugin")
+	mockFunc()
+	logger.Printf("Hot reload was successful")
+
+	res.OK = true
+	return res
+}
@@ -0,0 +1,167 @@
+package hot
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Call is a single recorded call of a spied function.
+type Call struct {
+	Args    []interface{} // for methods the receiver is the first argument
+	Results []interface{} // nil if the function panicked
+	Panic   interface{}   // the value the function panicked with, if any
+}
+
+// Recorder records the calls of a function that is spied on.
+type Recorder struct {
+	restore func()
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// Spy substitutes fn with a wrapper that calls the original implementation
+// and records the arguments, results and panics of every call.
+// Call Restore() to remove the spy.
+func Spy(fn interface{}) *Recorder {
+	fHash := getFuncPtr(fn)
+
+	rf, ok := lookupFunc(fHash)
+	if !ok {
+		panic("Function cannot be spied on, it is not registered")
+	}
+
+	r := &Recorder{}
+	typ := reflect.TypeOf(rf.fun)
+
+	wrapper := reflect.MakeFunc(typ, func(in []reflect.Value) []reflect.Value {
+		c := Call{Args: valuesToInterfaces(in)}
+
+		defer func() {
+			if p := recover(); p != nil {
+				c.Panic = p
+				r.record(c)
+				panic(p)
+			}
+		}()
+
+		out := callOriginalValues(rf, in, typ.IsVariadic())
+		c.Results = valuesToInterfaces(out)
+		r.record(c)
+
+		return out
+	})
+
+	prev := mock(fHash, wrapper.Interface())
+	r.restore = func() { restoreMock(fHash, prev) }
+	return r
+}
+
+// SpyT is like Spy, but the spy is removed when the test t and it's subtests complete.
+func SpyT(t TB, fn interface{}) *Recorder {
+	t.Helper()
+	r := Spy(fn)
+	t.Cleanup(r.Restore)
+	return r
+}
+
+func valuesToInterfaces(vals []reflect.Value) []interface{} {
+	res := make([]interface{}, 0, len(vals))
+	for _, v := range vals {
+		res = append(res, v.Interface())
+	}
+	return res
+}
+
+func (r *Recorder) record(c Call) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, c)
+}
+
+// Restore puts back the mock that was in place before the spy
+// (or the original implementation if there was none).
+func (r *Recorder) Restore() {
+	r.restore()
+}
+
+// Calls returns the calls that were recorded so far.
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Call(nil), r.calls...)
+}
+
+// CallCount returns the number of calls that were recorded so far.
+func (r *Recorder) CallCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.calls)
+}
+
+// CallsWith returns the number of recorded calls with the supplied arguments.
+// Variadic arguments are passed as a slice, just like the function receives them.
+func (r *Recorder) CallsWith(args ...interface{}) int {
+	n := 0
+	for _, c := range r.Calls() {
+		if reflect.DeepEqual(c.Args, args) {
+			n++
+		}
+	}
+	return n
+}
+
+// Reset forgets the calls that were recorded so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = nil
+}
+
+// AssertCalled reports an error to t unless the function was called exactly n times.
+func (r *Recorder) AssertCalled(t TB, n int) bool {
+	t.Helper()
+
+	if got := r.CallCount(); got != n {
+		t.Errorf("Expected %d call(s), got %d:\n%s", n, got, r.format())
+		return false
+	}
+	return true
+}
+
+// AssertCalledWith reports an error to t unless the function was called
+// exactly n times with the supplied arguments.
+func (r *Recorder) AssertCalledWith(t TB, n int, args ...interface{}) bool {
+	t.Helper()
+
+	if got := r.CallsWith(args...); got != n {
+		t.Errorf("Expected %d call(s) with %v, got %d:\n%s", n, args, got, r.format())
+		return false
+	}
+	return true
+}
+
+// format describes the recorded calls for error messages.
+func (r *Recorder) format() string {
+	calls := r.Calls()
+	if len(calls) == 0 {
+		return "\tno calls"
+	}
+
+	var b strings.Builder
+	for i, c := range calls {
+		fmt.Fprintf(&b, "\t%d: args %v", i+1, c.Args)
+		if c.Panic != nil {
+			fmt.Fprintf(&b, ", panic %v\n", c.Panic)
+		} else {
+			fmt.Fprintf(&b, ", results %v\n", c.Results)
+		}
+	}
+	return b.String()
+}
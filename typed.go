@@ -0,0 +1,62 @@
+//go:build go1.18
+// +build go1.18
+
+package hot
+
+import (
+	"context"
+	"reflect"
+)
+
+// MockFunc substitutes the src function with dst in runtime.
+// Unlike Mock the signatures of src and dst are checked at compile time.
+// In order to pass function pointers to methods you need to write
+// the following expression: `(*typeName).MethodName`.
+func MockFunc[F any](src F, dst F) {
+	mock(getFuncPtr(src), dst)
+}
+
+// MockFuncT is like MockT, but the signatures of src and dst are checked at compile time.
+func MockFuncT[F any](t TB, src F, dst F) {
+	t.Helper()
+	t.Cleanup(MockScoped(src, dst))
+}
+
+// MockFuncCtx is like MockCtx, but the signatures of src and dst are checked at compile time.
+func MockFuncCtx[F any](ctx context.Context, src F, dst F) context.Context {
+	return MockCtx(ctx, src, dst)
+}
+
+// Original returns a function with the signature of f that calls
+// the original implementation of f.
+// Recursive calls made by the original implementation go through the mock.
+func Original[F any](f F) F {
+	return originalFunc[F](getFuncPtr(f))
+}
+
+// OriginalByName is like Original, but the function is looked up by it's name
+// (see MockByName for the naming scheme). It panics if the function is not
+// registered or if it's signature is not F.
+func OriginalByName[F any](name string) F {
+	ptr, ok := lookupName(name)
+	if !ok {
+		panic("No function with the name `" + name + "` is registered")
+	}
+	return originalFunc[F](ptr)
+}
+
+func originalFunc[F any](fHash funcPtr) F {
+	rf, ok := lookupFunc(fHash)
+	if !ok {
+		panic("Function is not registered")
+	}
+
+	typ := reflect.TypeOf((*F)(nil)).Elem()
+	if typ.Kind() != reflect.Func || !typ.ConvertibleTo(reflect.TypeOf(rf.fun)) {
+		panic("Function signatures do not match")
+	}
+
+	return reflect.MakeFunc(typ, func(in []reflect.Value) []reflect.Value {
+		return callOriginalValues(rf, in, typ.IsVariadic())
+	}).Interface().(F)
+}